@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// The running total of an accumulate sensor, or the last value of a delta
+// sensor, persisted to ACCUMULATOR_FILE
+type accumulatorState struct {
+	Total   float64   `json:"total"`
+	Day     string    `json:"day"`     // Day the total is for, it restarts at 0 each midnight
+	Updated time.Time `json:"updated"` // Time the rate has been integrated up to
+
+	Last *float64 `json:"last,omitempty"` // Counter value the delta sensor last read
+}
+
+// Accumulate and delta sensor state by key, loaded on first use
+var (
+	accumulatorsMu sync.Mutex
+	accumulators   map[string]accumulatorState
+)
+
+// A sensor's state, loading the file the first time
+func accumulator(key string) accumulatorState {
+	accumulatorsMu.Lock()
+	defer accumulatorsMu.Unlock()
+	if accumulators == nil {
+		loadAccumulators()
+	}
+	return accumulators[key]
+}
+
+// Store a sensor's state and save them all to the file
+func setAccumulator(key string, state accumulatorState) {
+	accumulatorsMu.Lock()
+	defer accumulatorsMu.Unlock()
+	accumulators[key] = state
+	if err := saveAccumulators(); err != nil {
+		log.Printf("Error saving %s: %v", accumulatorFile, err)
+	}
+}
+
+func loadAccumulators() {
+	accumulators = make(map[string]accumulatorState)
+	if err := readStateFile(accumulatorFile, &accumulators); err != nil {
+		log.Printf("Error loading %s, accumulators start from 0: %v", accumulatorFile, err)
+	}
+}
+
+func saveAccumulators() error {
+	return writeStateFile(accumulatorFile, accumulators)
+}
+
+// Integrate the sensor's rate field, per hour, over the time since it was
+// last integrated and add it to today's total. The mean rate over that time
+// is queried, so time the bridge was down is counted once it is back. A
+// failed query leaves the total as it was, the next loop covers the gap.
+func queryAccumulated(ctx context.Context, sensor Sensor) ([]float64, error) {
+	now := clock()
+	today := now.Format(time.DateOnly)
+	state := accumulator(sensor.Key)
+	if state.Day != today {
+		state = accumulatorState{Day: today}
+	}
+	start := midnight(now)
+	if state.Updated.After(start) {
+		start = state.Updated
+	}
+	if !start.Before(now) {
+		return []float64{state.Total}, nil
+	}
+
+	rateSensor := sensor
+	rateSensor.Aggregation = "mean"
+	log.Printf("Querying InfluxDB for mean of %s data since %s...\n", sensor.Field, start.Format(time.RFC3339))
+	query, params := buildSensorQuery(rateSensor, start.Format(time.RFC3339Nano), now.Format(time.RFC3339Nano))
+	values, err := queryInfluxDBValue(ctx, sensor.Key, query, params, "_value")
+	if err != nil {
+		return nil, err
+	}
+	// No points since the last loop add nothing
+	if len(values) > 0 {
+		state.Total += lastValue(values) * now.Sub(start).Hours()
+	}
+	state.Updated = now
+	setAccumulator(sensor.Key, state)
+	return []float64{state.Total}, nil
+}
+
+// The rise of a delta sensor's counter since the value read by the previous
+// loop. A counter lower than before was reset, it has risen by its whole
+// value since. The first value read has nothing to compare with and gives 0.
+func (s Sensor) delta(values []float64) []float64 {
+	current := lastValue(values)
+	state := accumulator(s.Key)
+	var delta float64
+	switch {
+	case state.Last == nil:
+	case current < *state.Last:
+		log.Printf("%s counter dropped from %.2f to %.2f, taking it as a reset", s.Key, *state.Last, current)
+		delta = current
+	default:
+		delta = current - *state.Last
+	}
+	state.Last = &current
+	state.Updated = clock()
+	setAccumulator(s.Key, state)
+	return []float64{delta}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDelta(t *testing.T) {
+	defer func(file string, now func() time.Time) {
+		accumulatorFile, clock, accumulators = file, now, nil
+	}(accumulatorFile, clock)
+	accumulatorFile = filepath.Join(t.TempDir(), "accumulators.json")
+	accumulators = nil
+	now := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+
+	sensor := Sensor{Key: "rain-delta", Delta: true}
+	for _, step := range []struct {
+		counter, want float64
+	}{
+		{10, 0}, // Nothing to compare the first value with
+		{12.5, 2.5},
+		{1, 1}, // Reset
+	} {
+		got := sensor.delta([]float64{step.counter})
+		if len(got) != 1 || got[0] != step.want {
+			t.Errorf("delta() of %v = %v, want %v", step.counter, got, step.want)
+		}
+		if updated := accumulator(sensor.Key).Updated; !updated.Equal(now) {
+			t.Errorf("updated = %s, want the clock's %s", updated, now)
+		}
+		now = now.Add(2 * time.Minute)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Topic alert events are published to, MQTT_SENSOR and sensor key
+const mqttAlertTopic = "homeassistant/sensor/%s/%s/alert"
+
+// An alert event, published when a value crosses its alert threshold
+type alertEvent struct {
+	Sensor    string      `json:"sensor"`
+	Alert     bool        `json:"alert"`
+	Value     json.Number `json:"value"`
+	Threshold json.Number `json:"threshold"`
+}
+
+// Whether each sensor's alert is currently raised
+var (
+	alertsMu     sync.Mutex
+	alertsRaised = make(map[string]bool)
+)
+
+func (s Sensor) alertTopic() string {
+	if s.AlertTopic != "" {
+		return s.AlertTopic
+	}
+	return fmt.Sprintf(mqttAlertTopic, mqttSensor, s.Key)
+}
+
+// Publish an alert event when the value crosses the sensor's alert threshold.
+// The alert is raised above the threshold and only cleared once the value
+// drops below the threshold minus the hysteresis, so a value hovering around
+// the threshold doesn't flap. A value below the threshold at startup isn't
+// an event.
+func checkAlert(conns []*mqttConnection, sensor Sensor, value float64) {
+	if sensor.AlertThreshold == nil {
+		return
+	}
+	threshold := sensor.alertThreshold()
+
+	alertsMu.Lock()
+	raised := alertsRaised[sensor.Key]
+	switch {
+	case !raised && value > threshold:
+		raised = true
+	case raised && value < threshold-sensor.AlertHysteresis:
+		raised = false
+	default:
+		alertsMu.Unlock()
+		return
+	}
+	alertsRaised[sensor.Key] = raised
+	alertsMu.Unlock()
+
+	payload, err := json.Marshal(alertEvent{
+		Sensor:    sensor.Key,
+		Alert:     raised,
+		Value:     json.Number(fmt.Sprintf("%.2f", value)),
+		Threshold: json.Number(fmt.Sprintf("%.2f", threshold)),
+	})
+	if err != nil {
+		log.Printf("Error marshalling %s alert: %v", sensor.Key, err)
+		return
+	}
+	if raised {
+		log.Printf("Alert raised for %s: %.2f is above %.2f", sensor.Key, value, threshold)
+	} else {
+		log.Printf("Alert cleared for %s: %.2f is below %.2f", sensor.Key, value, threshold-sensor.AlertHysteresis)
+	}
+	if err := publishAll(conns, sensor.alertTopic(), 1, false, payload); err != nil {
+		log.Printf("Error publishing %s alert: %v", sensor.Key, err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// The attributes published to a sensor's json_attributes_topic. Each
+// publish replaces all of them, so they are collected into one payload.
+type sensorAttributes struct {
+	Recent []json.Number `json:"recent,omitempty"` // Oldest first, see recent_samples
+
+	// With LAST_VALUE_FILE, whether the sensor publishes its stored result
+	// instead of a queried one and the time that result was queried
+	Stale *bool  `json:"stale,omitempty"`
+	Since string `json:"since,omitempty"`
+}
+
+// The attributes payload last published for each sensor, unchanged ones
+// aren't published again
+var publishedAttributes = map[string]string{}
+
+func (s Sensor) attributesTopic() string {
+	return s.stateTopic() + "/attributes"
+}
+
+func (s Sensor) hasAttributes() bool {
+	return s.RecentSamples > 0 || lastValueFile != ""
+}
+
+// Publish a sensor's attributes, retained so Home Assistant has them after a
+// restart. Without the recent samples nothing is published, the last
+// attributes are kept until the query works again.
+func publishAttributes(ctx context.Context, conns []*mqttConnection, sensor Sensor) error {
+	var attributes sensorAttributes
+	if sensor.RecentSamples > 0 {
+		recent, err := queryRecentSamples(ctx, sensor)
+		if err != nil {
+			return err
+		}
+		attributes.Recent = recent
+	}
+	if lastValueFile != "" {
+		stale := staleSensors[sensor.Key]
+		attributes.Stale = &stale
+		if stale {
+			attributes.Since = lastResults[sensor.Key].Time.Format(time.RFC3339)
+		}
+	}
+
+	payload, err := json.Marshal(attributes)
+	if err != nil {
+		return err
+	}
+	if publishedAttributes[sensor.Key] == string(payload) {
+		return nil
+	}
+	if err := publishAll(conns, sensor.attributesTopic(), stateQoS, true, payload); err != nil {
+		return err
+	}
+	log.Printf("Published to %s: %s", sensor.attributesTopic(), payload)
+	publishedAttributes[sensor.Key] = string(payload)
+	return nil
+}
+
+// Clear the retained attributes of a sensor that is gone
+func clearAttributes(conns []*mqttConnection, sensor Sensor) {
+	if _, published := publishedAttributes[sensor.Key]; !published {
+		return
+	}
+	if err := publishAll(conns, sensor.attributesTopic(), stateQoS, true, ""); err != nil {
+		log.Printf("Error clearing %s attributes: %v", sensor.Key, err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestPublishAttributes(t *testing.T) {
+	server := fakeInflux(t, nil)
+	published := make(chan brokerMessage, 10)
+	target := mqttTarget{Broker: fakeBroker(t, published), ClientID: "bridge-test"}
+	client := mqtt.NewClient(newMqttOptions(target))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	conns := []*mqttConnection{{target: target, client: client}}
+
+	defer func(url, file string) { influxQueryURL, lastValueFile = url, file }(influxQueryURL, lastValueFile)
+	influxQueryURL, lastValueFile = server.URL, "last-values.json"
+	defer func() { clear(publishedAttributes); clear(staleSensors); clear(lastResults) }()
+
+	sensor := Sensor{Key: "rain", Field: "rain", Aggregation: "sum", RecentSamples: 3}
+	lastResults[sensor.Key] = storedResult{[]float64{2}, time.Date(2024, 6, 1, 10, 2, 0, 0, time.UTC)}
+	staleSensors[sensor.Key] = true
+
+	// The recent samples and the staleness share one retained payload
+	if err := publishAttributes(context.Background(), conns, sensor); err != nil {
+		t.Fatal(err)
+	}
+	want := brokerMessage{sensor.attributesTopic(), `{"recent":[1.50,2.50,4.00],"stale":true,"since":"2024-06-01T10:02:00Z"}`, true}
+	select {
+	case got := <-published:
+		if got != want {
+			t.Errorf("published %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("attributes not published")
+	}
+
+	// Unchanged attributes aren't published again
+	if err := publishAttributes(context.Background(), conns, sensor); err != nil {
+		t.Fatal(err)
+	}
+	staleSensors[sensor.Key] = false
+	if err := publishAttributes(context.Background(), conns, sensor); err != nil {
+		t.Fatal(err)
+	}
+	want.payload = `{"recent":[1.50,2.50,4.00],"stale":false}`
+	select {
+	case got := <-published:
+		if got != want {
+			t.Errorf("published %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("attributes not published")
+	}
+}
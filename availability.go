@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Availability message with AVAILABILITY_JSON=true, read by the discovery
+// config's availability_template
+type availabilityState struct {
+	State string `json:"state"`
+	Time  string `json:"time,omitempty"`
+}
+
+// The payload marking the device online or offline. The offline payload is
+// the Will, set when connecting, so it has no time.
+func availabilityPayload(state string) string {
+	if !availabilityJSON {
+		return state
+	}
+	payload := availabilityState{State: state}
+	if state == "online" {
+		payload.Time = time.Now().Format(time.RFC3339)
+	}
+	data, _ := json.Marshal(payload)
+	return string(data)
+}
+
+// With AVAILABILITY_INTERVAL, publish online on a timer of its own instead of
+// after every state, so the heartbeat keeps one cadence however the states
+// are published. Nothing is sent during a maintenance window.
+func publishAvailabilityHeartbeat(conns []*mqttConnection) {
+	ticker := time.NewTicker(availabilityInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if maintenanceActive.Load() {
+			continue
+		}
+		if err := publishAll(conns, fmt.Sprintf(mqttAvail, mqttSensor), availabilityQoS, true, availabilityPayload("online")); err != nil {
+			logThrottled("availability "+err.Error(), "Error publishing availability: %v", err)
+		}
+	}
+}
+
+// Point a discovery config at the availability topic
+func setAvailability(config *MqttConfig) {
+	config.AvailabilityTopic = fmt.Sprintf(mqttAvail, mqttSensor)
+	config.PayloadAvailable = "online"
+	config.PayloadNotAvailable = "offline"
+	if availabilityJSON {
+		config.AvailabilityTemplate = availabilityTemplate
+	}
+}
+
+// One of the topics of a discovery config's availability list
+type availabilityTopicConfig struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+	ValueTemplate       string `json:"value_template,omitempty"`
+}
+
+// Replace a discovery config's availability topic with a list of it and the
+// sensor's own availability topic, both of which have to be online
+func addSensorAvailability(config *MqttConfig, sensor Sensor) {
+	config.Availability = []availabilityTopicConfig{
+		{config.AvailabilityTopic, config.PayloadAvailable, config.PayloadNotAvailable, config.AvailabilityTemplate},
+		{sensor.availabilityTopic(), "online", "offline", ""},
+	}
+	config.AvailabilityMode = "all"
+	config.AvailabilityTopic, config.PayloadAvailable, config.PayloadNotAvailable, config.AvailabilityTemplate = "", "", "", ""
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A day's value published by --backfill-days
+type backfillRecord struct {
+	Sensor string      `json:"sensor"`
+	Start  string      `json:"start"`
+	End    string      `json:"end"`
+	Value  interface{} `json:"value"`
+	Unit   string      `json:"unit,omitempty"`
+
+	number float64 // The value before it is formatted
+}
+
+func (s Sensor) backfillTopic() string {
+	return s.stateTopic() + "/backfill"
+}
+
+// Query every daily sensor for each of the past days, oldest first, and
+// publish the results to the sensors' backfill topics. Home Assistant records
+// a state with the time it arrives, so past values can't be sent to the state
+// topics. With HA_URL they are imported into its long term statistics
+// instead, see README.md. Returns the failed queries, publishes and imports.
+func runBackfill(conns []*mqttConnection, days int) error {
+	var ha *homeAssistant
+	if haURL != "" {
+		var err error
+		if ha, err = dialHomeAssistant(haURL, haToken); err != nil {
+			return fmt.Errorf("connecting to Home Assistant at %s: %w", haURL, err)
+		}
+		defer ha.Close()
+	}
+
+	today := midnight(clock())
+	var errs []error
+	imports := make(map[string][]backfillRecord)
+	for d := days; d >= 1; d-- {
+		start := time.Date(today.Year(), today.Month(), today.Day()-d, 0, 0, 0, 0, today.Location())
+		end := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+		log.Printf("Backfilling %s", start.Format("2006-01-02"))
+
+		for _, sensor := range sensors {
+			if (sensor.Window != "" && sensor.Window != "today") || sensor.Compute != "" || sensor.Accumulate || sensor.Delta {
+				continue
+			}
+
+			query, params := buildSensorQuery(sensor, start.Format(time.RFC3339), end.Format(time.RFC3339))
+			values, err := sensor.queryRecords(context.Background(), query, params)
+			if err != nil {
+				log.Printf("Error querying %s data for %s: %v", sensor.Key, start.Format("2006-01-02"), err)
+				errs = append(errs, fmt.Errorf("querying %s for %s: %w", sensor.Key, start.Format("2006-01-02"), err))
+				continue
+			}
+			values = sensor.clamp(sensor.convert(values))
+
+			var value interface{} = sensor.formatValue(lastValue(values))
+			if !sensor.publishesText() {
+				value = json.Number(sensor.formatValue(lastValue(values)))
+			}
+			record := backfillRecord{
+				Sensor: sensor.Key,
+				Start:  start.Format(time.RFC3339),
+				End:    end.Format(time.RFC3339),
+				Value:  value,
+				Unit:   sensor.Unit,
+				number: lastValue(values),
+			}
+			if len(values) > 0 && sensor.importsStatistics() {
+				imports[sensor.Key] = append(imports[sensor.Key], record)
+			}
+
+			payload, err := json.Marshal(record)
+			if err != nil {
+				log.Printf("Error marshalling backfill for %s: %v", sensor.Key, err)
+				continue
+			}
+			if err := publishAll(conns, sensor.backfillTopic(), 1, false, payload); err != nil {
+				log.Printf("Error publishing %s backfill for %s: %v", sensor.Key, start.Format("2006-01-02"), err)
+				errs = append(errs, fmt.Errorf("publishing %s for %s: %w", sensor.Key, start.Format("2006-01-02"), err))
+				continue
+			}
+			log.Printf("Published to %s: %s", sensor.backfillTopic(), payload)
+		}
+	}
+
+	if ha != nil {
+		for _, sensor := range sensors {
+			records, ok := imports[sensor.Key]
+			if !ok {
+				continue
+			}
+			if err := ha.importStatistics(sensor, records); err != nil {
+				log.Printf("Error importing %s statistics: %v", sensor.entityID(), err)
+				errs = append(errs, fmt.Errorf("importing %s statistics: %w", sensor.entityID(), err))
+				continue
+			}
+			log.Printf("Imported %d days into the %s statistics", len(records), sensor.entityID())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("backfilled %d days with %d failures: %w", days, len(errs), errors.Join(errs...))
+	}
+	fmt.Printf("Backfilled %d days\n", days)
+	return nil
+}
+
+// Whether Home Assistant keeps long term statistics of the sensor, which
+// needs a numeric sensor with a state class
+func (s Sensor) importsStatistics() bool {
+	return s.StateClass != "" && !s.publishesText() && s.component() == "sensor"
+}
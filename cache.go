@@ -0,0 +1,54 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// A sensor's last result, kept for its cache_ttl
+type cachedValues struct {
+	values  []float64
+	start   string // Range start of the query, a new day makes a new start
+	fetched time.Time
+}
+
+var (
+	cacheMu     sync.Mutex
+	resultCache = map[string]cachedValues{}
+)
+
+func (s Sensor) cacheTTL() time.Duration {
+	ttl, _ := time.ParseDuration(s.CacheTTL) // Checked by validateSensor
+	return ttl
+}
+
+// The cached result of a sensor with a cache_ttl, when it is younger than
+// the TTL and was queried over the same range. A result from before midnight
+// is never used, the daily values start again then, so the first loop of a
+// day always queries InfluxDB.
+func cachedResult(sensor Sensor, start string) ([]float64, bool) {
+	if sensor.CacheTTL == "" {
+		return nil, false
+	}
+	cacheMu.Lock()
+	cached, ok := resultCache[sensor.Key]
+	cacheMu.Unlock()
+	if !ok || cached.start != start || clock().Sub(cached.fetched) >= sensor.cacheTTL() {
+		return nil, false
+	}
+	if cached.fetched.Before(midnight(clock())) {
+		return nil, false
+	}
+	// A copy, the loop changes the values it publishes
+	return slices.Clone(cached.values), true
+}
+
+func cacheResult(sensor Sensor, start string, values []float64) {
+	if sensor.CacheTTL == "" {
+		return
+	}
+	cacheMu.Lock()
+	resultCache[sensor.Key] = cachedValues{slices.Clone(values), start, clock()}
+	cacheMu.Unlock()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+
+	"github.com/Knetic/govaluate"
+)
+
+// Inputs of each computed sensor and the logical fields they are read from
+// unless the sensor's inputs map them to others
+var computeInputs = map[string][]string{
+	"heat_index": {"temperature", "humidity"},
+	"wind_chill": {"temperature", "wind"},
+	"feels_like": {"temperature", "humidity", "wind"},
+	"trend":      {"pressure"},
+}
+
+func (s Sensor) inputField(input string) string {
+	if field, ok := s.Inputs[input]; ok {
+		return field
+	}
+	return input
+}
+
+// The inputs of a computed sensor, the variables of its expression or those
+// of its formula
+func (s Sensor) computeInputs() []string {
+	if s.Compute == "expression" {
+		expression, err := govaluate.NewEvaluableExpression(s.Expression)
+		if err != nil {
+			return nil // Checked when the config is loaded
+		}
+		return expressionVars(expression)
+	}
+	return computeInputs[s.Compute]
+}
+
+// Query the latest reading of each input of a computed sensor and apply its
+// formula. Temperatures are in °C, humidity in % and wind speed in km/h.
+func queryComputed(ctx context.Context, sensor Sensor) ([]float64, error) {
+	readings := make(map[string]float64)
+	for _, input := range sensor.computeInputs() {
+		inputSensor := sensor
+		inputSensor.Key = sensor.Key + "-" + input
+		inputSensor.Field = sensor.inputField(input)
+		inputSensor.Aggregation = "last"
+		// The valid range is checked on the computed value instead
+		inputSensor.ValidMin, inputSensor.ValidMax = nil, nil
+
+		log.Printf("Querying InfluxDB for last of %s data...\n", inputSensor.Field)
+		query, params := buildSensorQuery(inputSensor, queryRangeStart(inputSensor), queryStop)
+		values, err := queryInfluxDBValue(ctx, inputSensor.Key, query, params, "_value")
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("no %s readings for %s: %w", inputSensor.Field, sensor.Key, ErrNoData)
+		}
+		readings[input] = lastValue(values)
+	}
+
+	var value float64
+	switch sensor.Compute {
+	case "expression":
+		var err error
+		if value, err = evaluateExpression(sensor.Expression, readings); err != nil {
+			return nil, fmt.Errorf("%s: %v", sensor.Key, err)
+		}
+	case "heat_index":
+		value = heatIndex(readings["temperature"], readings["humidity"])
+	case "wind_chill":
+		value = windChill(readings["temperature"], readings["wind"])
+	case "feels_like":
+		value = feelsLike(readings["temperature"], readings["humidity"], readings["wind"])
+	case "trend":
+		var err error
+		if value, err = queryTrend(ctx, sensor, readings["pressure"]); err != nil {
+			return nil, err
+		}
+	}
+	return []float64{value}, nil
+}
+
+// The NWS heat index (Rothfusz regression with its adjustments) in °C. Below
+// 26.7°C (80°F) the air temperature is returned, the formula isn't valid there.
+func heatIndex(celsius, humidity float64) float64 {
+	t := celsius*9/5 + 32
+	if t < 80 {
+		return celsius
+	}
+
+	hi := -42.379 + 2.04901523*t + 10.14333127*humidity - 0.22475541*t*humidity -
+		0.00683783*t*t - 0.05481717*humidity*humidity + 0.00122874*t*t*humidity +
+		0.00085282*t*humidity*humidity - 0.00000199*t*t*humidity*humidity
+	if humidity < 13 && t <= 112 {
+		hi -= (13 - humidity) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+	} else if humidity > 85 && t <= 87 {
+		hi += (humidity - 85) / 10 * (87 - t) / 5
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// The North American wind chill index in °C for a wind speed in km/h. It is
+// only defined at or below 10°C with wind above 4.8 km/h, otherwise the air
+// temperature is returned.
+func windChill(celsius, wind float64) float64 {
+	if celsius > 10 || wind <= 4.8 {
+		return celsius
+	}
+	v := math.Pow(wind, 0.16)
+	return 13.12 + 0.6215*celsius - 11.37*v + 0.3965*celsius*v
+}
+
+// The heat index when it's hot, the wind chill when it's cold and windy and
+// the air temperature in between
+func feelsLike(celsius, humidity, wind float64) float64 {
+	if hi := heatIndex(celsius, humidity); hi != celsius {
+		return hi
+	}
+	return windChill(celsius, wind)
+}
+
+// The variables of an expression, sorted and each once
+func expressionVars(expression *govaluate.EvaluableExpression) []string {
+	vars := expression.Vars()
+	slices.Sort(vars)
+	return slices.Compact(vars)
+}
+
+// Evaluate a user expression over the input readings. A comparison gives 1
+// or 0. Dividing by zero gives an error rather than publishing Inf or NaN.
+func evaluateExpression(source string, readings map[string]float64) (float64, error) {
+	expression, err := govaluate.NewEvaluableExpression(source)
+	if err != nil {
+		return 0, err
+	}
+	parameters := make(map[string]interface{}, len(readings))
+	for name, value := range readings {
+		parameters[name] = value
+	}
+	result, err := expression.Evaluate(parameters)
+	if err != nil {
+		return 0, err
+	}
+
+	var value float64
+	switch v := result.(type) {
+	case float64:
+		value = v
+	case bool:
+		if v {
+			value = 1
+		}
+	default:
+		return 0, fmt.Errorf("expression gave %v, not a number", result)
+	}
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("expression gave %v, e.g. from a division by zero", value)
+	}
+	return value, nil
+}
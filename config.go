@@ -0,0 +1,758 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Knetic/govaluate"
+)
+
+// Optional JSON config file, see README.md for the format
+type Config struct {
+	Sensors      []json.RawMessage       `json:"sensors"`
+	Fields       map[string]FieldMapping `json:"fields"`
+	FluxPreamble string                  `json:"flux_preamble"` // Imports and options put before every query
+	Device       DeviceConfig            `json:"device"`
+
+	// Named overlays, one of which PROFILE merges over the rest of the file
+	Profiles map[string]Config `json:"profiles"`
+}
+
+// Extra identifiers and connections of the bridge's device, linking it to
+// other integrations' entries for the same hardware in Home Assistant
+type DeviceConfig struct {
+	Identifiers []string    `json:"identifiers"`
+	Connections [][2]string `json:"connections"`
+}
+
+// Where a sensor's logical field is stored in InfluxDB
+type FieldMapping struct {
+	Measurement string `json:"measurement"`
+	Field       string `json:"field"`
+}
+
+// Logical field mappings from the config file, see resolveField
+var fieldMappings map[string]FieldMapping
+
+// Flux imports and options from the config file, see withPreamble
+var fluxPreamble string
+
+// Device identifiers after MQTT_SENSOR and connections from the config file
+var (
+	deviceIdentifiers []string
+	deviceConnections [][2]string
+)
+
+// Sensors and settings read from the config file, put in use together
+type loadedConfig struct {
+	sensors           []Sensor
+	fieldMappings     map[string]FieldMapping
+	fluxPreamble      string
+	deviceIdentifiers []string
+	deviceConnections [][2]string
+}
+
+// Load the sensors and field mappings, applying the config file (if any)
+// over the built in sensors
+func loadConfig(path string) {
+	loaded, err := readConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	useConfig(loaded)
+	if path != "" {
+		log.Printf("Loaded config file %s (%d sensors)", path, len(sensors))
+	}
+}
+
+// Read and validate the config file, the built in sensors when path is
+// empty. Nothing is put in use, see useConfig.
+func readConfig(path string) (loadedConfig, error) {
+	base := append([]Sensor(nil), defaultSensors...)
+	if path == "" {
+		if profile != "" {
+			return loadedConfig{}, fmt.Errorf("PROFILE %s needs a CONFIG_FILE", profile)
+		}
+		return loadedConfig{sensors: enabledSensors(base)}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return loadedConfig{}, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return loadedConfig{}, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	if profile != "" {
+		overlay, ok := config.Profiles[profile]
+		if !ok {
+			return loadedConfig{}, fmt.Errorf("config file %s has no profile %q", path, profile)
+		}
+		if len(overlay.Profiles) > 0 {
+			return loadedConfig{}, fmt.Errorf("invalid config file %s: profile %s can't have profiles", path, profile)
+		}
+		config = withProfile(config, overlay)
+		log.Printf("Using profile %s", profile)
+	}
+	base, err = applyConfig(base, config)
+	if err != nil {
+		return loadedConfig{}, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return loadedConfig{
+		sensors:           enabledSensors(base),
+		fieldMappings:     config.Fields,
+		fluxPreamble:      config.FluxPreamble,
+		deviceIdentifiers: config.Device.Identifiers,
+		deviceConnections: config.Device.Connections,
+	}, nil
+}
+
+// Guards the config in use against a SIGHUP reload while the discovery
+// config is republished or the alert numbers are subscribed to
+var configMu sync.Mutex
+
+func useConfig(loaded loadedConfig) {
+	sensors = loaded.sensors
+	fieldMappings = loaded.fieldMappings
+	fluxPreamble = loaded.fluxPreamble
+	deviceIdentifiers = loaded.deviceIdentifiers
+	deviceConnections = loaded.deviceConnections
+}
+
+var nonEnvCharacters = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// The variable turning a sensor key or field on or off, e.g.
+// SENSOR_PRESSURE_MIN_ENABLED for pressure-min
+func sensorEnabledVariable(name string) string {
+	return "SENSOR_" + strings.Trim(nonEnvCharacters.ReplaceAllString(strings.ToUpper(name), "_"), "_") + "_ENABLED"
+}
+
+var sensorEnabledPattern = regexp.MustCompile(`^SENSOR_[A-Z0-9_]+_ENABLED$`)
+
+// Drop the sensors turned off with SENSOR_<KEY>_ENABLED=false, or with
+// SENSOR_<FIELD>_ENABLED=false for every sensor of a field. The key's
+// variable wins over the field's. Variables matching no sensor are logged,
+// they are most likely typos.
+func enabledSensors(all []Sensor) []Sensor {
+	used := make(map[string]bool)
+	var enabled []Sensor
+	for _, sensor := range all {
+		on := true
+		for _, name := range []string{sensor.Field, sensor.Key} {
+			if name == "" {
+				continue
+			}
+			variable := sensorEnabledVariable(name)
+			value, exists := os.LookupEnv(variable)
+			if !exists {
+				continue
+			}
+			used[variable] = true
+			switch value {
+			case "true":
+				on = true
+			case "false":
+				on = false
+			default:
+				log.Fatalf("Invalid %s %q, use true or false", variable, value)
+			}
+		}
+		if on {
+			enabled = append(enabled, sensor)
+		} else {
+			log.Printf("Sensor %s is turned off", sensor.Key)
+		}
+	}
+	for _, entry := range os.Environ() {
+		variable, _, _ := strings.Cut(entry, "=")
+		if sensorEnabledPattern.MatchString(variable) && !used[variable] {
+			log.Printf("Warning: %s doesn't match a sensor key or field", variable)
+		}
+	}
+	return enabled
+}
+
+// Merge a profile over the base config. Its sensors are applied after the
+// base config's, so they override the fields they set like any later entry,
+// its field mappings replace those of the same name and its flux_preamble and
+// device, when set, replace the base ones.
+func withProfile(base, overlay Config) Config {
+	merged := Config{
+		Sensors:      append(append([]json.RawMessage(nil), base.Sensors...), overlay.Sensors...),
+		Fields:       make(map[string]FieldMapping, len(base.Fields)+len(overlay.Fields)),
+		FluxPreamble: base.FluxPreamble,
+	}
+	for name, mapping := range base.Fields {
+		merged.Fields[name] = mapping
+	}
+	for name, mapping := range overlay.Fields {
+		merged.Fields[name] = mapping
+	}
+	if overlay.FluxPreamble != "" {
+		merged.FluxPreamble = overlay.FluxPreamble
+	}
+	merged.Device = base.Device
+	if len(overlay.Device.Identifiers) > 0 || len(overlay.Device.Connections) > 0 {
+		merged.Device = overlay.Device
+	}
+	return merged
+}
+
+// Apply the config's sensors over base. An entry whose key matches a sensor
+// only overrides the fields it sets, any other key adds a new sensor.
+func applyConfig(base []Sensor, config Config) ([]Sensor, error) {
+	if err := validatePreamble(config.FluxPreamble); err != nil {
+		return nil, fmt.Errorf("flux_preamble: %v", err)
+	}
+	for name, mapping := range config.Fields {
+		if mapping.Measurement == "" && mapping.Field == "" {
+			return nil, fmt.Errorf("field %s: needs a measurement or field", name)
+		}
+	}
+	for _, identifier := range config.Device.Identifiers {
+		if identifier == "" {
+			return nil, fmt.Errorf("device: empty identifier")
+		}
+	}
+	for _, connection := range config.Device.Connections {
+		if connection[0] == "" || connection[1] == "" {
+			return nil, fmt.Errorf("device: connection %q needs a type and an id", connection)
+		}
+	}
+
+	for _, raw := range config.Sensors {
+		var entry struct {
+			Key          string   `json:"key"`
+			Name         string   `json:"name"`
+			JSONKey      string   `json:"json_key"`
+			JSONGroup    string   `json:"json_group"`
+			Aggregations []string `json:"aggregations"`
+			Windows      []string `json:"windows"`
+			Current      bool     `json:"current"`
+		}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, err
+		}
+		if entry.Key == "" {
+			return nil, fmt.Errorf("sensor without a key")
+		}
+
+		if entry.Current {
+			// The latest reading of the field next to its aggregations, e.g.
+			// temperature-current named "Current Temperature"
+			key := entry.Key + "-current"
+			target := findSensor(&base, key)
+			if err := json.Unmarshal(raw, target); err != nil {
+				return nil, fmt.Errorf("sensor %s: %v", key, err)
+			}
+			target.Key = key
+			target.Aggregation = "last"
+			target.Aggregations, target.Windows = nil, nil
+			target.AggregateEvery = ""
+			target.WindowValues = ""
+			if entry.Name != "" {
+				target.Name = aggregationLabel("last") + " " + entry.Name
+			}
+			if entry.JSONKey != "" {
+				target.JSONKey = entry.JSONKey + "_current"
+			} else if entry.JSONGroup != "" {
+				target.JSONKey = "current"
+			}
+		}
+
+		// Expand into one sensor per aggregation and window, e.g.
+		// temperature-min with the name "Minimum Temperature", or
+		// wind-gust-max-10m named "Maximum Wind Gust 10m"
+		aggregations := entry.Aggregations
+		if len(aggregations) == 0 {
+			aggregations = []string{""}
+		}
+		windows := entry.Windows
+		if len(windows) == 0 {
+			windows = []string{""}
+		}
+		for _, agg := range aggregations {
+			for _, window := range windows {
+				var suffixes []string
+				if agg != "" {
+					suffixes = append(suffixes, agg)
+				}
+				if window != "" {
+					suffixes = append(suffixes, window)
+				}
+				key := strings.Join(append([]string{entry.Key}, suffixes...), "-")
+				target := findSensor(&base, key)
+				if err := json.Unmarshal(raw, target); err != nil {
+					return nil, fmt.Errorf("sensor %s: %v", key, err)
+				}
+				target.Key = key
+				target.Aggregations, target.Windows = nil, nil
+				if agg != "" {
+					target.Aggregation = agg
+				}
+				if window != "" {
+					target.Window = window
+				}
+				if entry.Name != "" {
+					target.Name = expandedName(entry.Name, agg, window)
+				}
+				if len(suffixes) == 0 {
+					continue
+				}
+				if entry.JSONKey != "" {
+					target.JSONKey = entry.JSONKey + "_" + strings.Join(suffixes, "_")
+				} else if entry.JSONGroup != "" {
+					target.JSONKey = strings.Join(suffixes, "_")
+				}
+			}
+		}
+	}
+
+	if err := validateJSONKeys(base); err != nil {
+		return nil, err
+	}
+
+	stateTopics := make(map[string]string)
+	for _, s := range base {
+		if err := validateSensor(s); err != nil {
+			return nil, fmt.Errorf("sensor %s: %v", s.Key, err)
+		}
+		if other, taken := stateTopics[s.StateTopic]; taken && s.hasExternalTopic() {
+			return nil, fmt.Errorf("sensor %s: state_topic %s is already used by %s", s.Key, s.StateTopic, other)
+		}
+		stateTopics[s.StateTopic] = s.Key
+	}
+	return base, nil
+}
+
+// The sensor with key, appending a new one when there is none
+func findSensor(sensors *[]Sensor, key string) *Sensor {
+	for i := range *sensors {
+		if (*sensors)[i].Key == key {
+			return &(*sensors)[i]
+		}
+	}
+	*sensors = append(*sensors, Sensor{Key: key})
+	return &(*sensors)[len(*sensors)-1]
+}
+
+// Name prefixes for sensors expanded from aggregations
+var aggregationLabels = map[string]string{
+	"sum": "Total", "increase": "Total", "min": "Minimum", "max": "Maximum",
+	"mean": "Average", "median": "Median", "first": "First", "last": "Current",
+	"count": "Count of", "spread": "Spread of", "quantile": "Percentile",
+}
+
+func aggregationLabel(agg string) string {
+	if label, ok := aggregationLabels[agg]; ok {
+		return label
+	}
+	return agg
+}
+
+// The name of a sensor expanded from an aggregation and window, e.g.
+// "Maximum Wind Gust 10m" or "Wind Gust Today"
+func expandedName(name, agg, window string) string {
+	if agg != "" {
+		name = aggregationLabel(agg) + " " + name
+	}
+	switch window {
+	case "":
+	case "today":
+		name += " Today"
+	default:
+		name += " " + window
+	}
+	return name
+}
+
+// Aggregations a sensor can use
+var validAggregations = map[string]bool{
+	"sum": true, "min": true, "max": true, "mean": true, "median": true,
+	"first": true, "last": true, "count": true, "spread": true,
+	"increase": true, // For counters that reset, e.g. a raw rain counter
+	"quantile": true, // With quantile, e.g. 0.95 for the 95th percentile
+}
+
+var fluxDuration = regexp.MustCompile(`^([0-9]+(ns|us|µs|ms|s|m|h|d|w|mo|y))+$`)
+
+func validateSensor(s Sensor) error {
+	if s.Name == "" {
+		return fmt.Errorf("needs a name")
+	}
+	if strings.ContainsAny(s.StateTopic, "+#") {
+		return fmt.Errorf("state_topic %q can't contain wildcards", s.StateTopic)
+	}
+	if strings.ContainsAny(s.AlertTopic, "+#") {
+		return fmt.Errorf("alert_topic %q can't contain wildcards", s.AlertTopic)
+	}
+	if s.AlertThreshold == nil && (s.AlertHysteresis != 0 || s.AlertTopic != "") {
+		return fmt.Errorf("alert_hysteresis and alert_topic need an alert_threshold")
+	}
+	if s.AlertHysteresis < 0 {
+		return fmt.Errorf("alert_hysteresis can't be negative")
+	}
+	if n := s.AlertNumber; n != nil {
+		if s.AlertThreshold == nil {
+			return fmt.Errorf("alert_number needs an alert_threshold")
+		}
+		if n.Min >= n.Max || n.Step < 0 {
+			return fmt.Errorf("alert_number needs a min below its max and a positive step")
+		}
+		if *s.AlertThreshold < n.Min || *s.AlertThreshold > n.Max {
+			return fmt.Errorf("alert_threshold is outside the alert_number range")
+		}
+	}
+	if err := validatePreamble(s.FluxPreamble); err != nil {
+		return fmt.Errorf("flux_preamble: %v", err)
+	}
+	if s.Rounding != "" && !roundingModes[s.Rounding] {
+		return fmt.Errorf("unknown rounding %q, use nearest, floor, ceil or truncate", s.Rounding)
+	}
+	if s.NumberFormat != "" {
+		if !numberFormatPattern.MatchString(s.NumberFormat) {
+			return fmt.Errorf("number_format %q is not a format such as %%.1f, %%.0f or %%g", s.NumberFormat)
+		}
+		if !strings.HasSuffix(s.NumberFormat, "f") && s.rounding() != "nearest" {
+			return fmt.Errorf("rounding %s needs a %%f number_format, %s is only rounded to nearest", s.rounding(), s.NumberFormat)
+		}
+		if s.publishesText() {
+			return fmt.Errorf("number_format can't be used with a binary_sensor or format")
+		}
+	}
+	if err := validateSourceUnit(s); err != nil {
+		return err
+	}
+	if s.ClampMin != nil && s.ClampMax != nil && *s.ClampMin > *s.ClampMax {
+		return fmt.Errorf("clamp_min is above clamp_max")
+	}
+	if s.ValidMin != nil && s.ValidMax != nil && *s.ValidMin > *s.ValidMax {
+		return fmt.Errorf("valid_min is above valid_max")
+	}
+	if s.Window != "" && s.Window != "today" && !fluxDuration.MatchString(s.Window) {
+		return fmt.Errorf("window %q is not today or a Flux duration", s.Window)
+	}
+	if s.NoDataBehavior != "" && !noDataBehaviors[s.NoDataBehavior] {
+		return fmt.Errorf("unknown no_data_behavior %q, use zero, unavailable, last_value or skip", s.NoDataBehavior)
+	}
+	if s.NoDataBehavior == "unavailable" && s.hasExternalTopic() {
+		return fmt.Errorf("no_data_behavior unavailable needs a discovery config, it can't be used with state_topic")
+	}
+	if s.CacheTTL != "" {
+		if ttl, err := time.ParseDuration(s.CacheTTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("cache_ttl %q is not a positive duration such as 10m", s.CacheTTL)
+		}
+		if s.Compute != "" || s.Accumulate {
+			return fmt.Errorf("cache_ttl can't be used with compute or accumulate")
+		}
+	}
+	if s.Delta && (s.Compute != "" || s.Accumulate || s.CacheTTL != "" || s.publishesArray()) {
+		return fmt.Errorf("delta can't be used with compute, accumulate, cache_ttl or window_values array")
+	}
+	switch s.Tables {
+	case "", "sum", "mean", "min", "max":
+	default:
+		return fmt.Errorf("unknown tables %q, use sum, mean, min or max", s.Tables)
+	}
+	if s.Tables != "" && (s.Compute != "" || s.Accumulate || s.publishesArray()) {
+		return fmt.Errorf("tables can't be used with compute, accumulate or window_values array")
+	}
+	for key := range s.Tags {
+		if key == "" || strings.HasPrefix(key, "_") {
+			return fmt.Errorf("tags need tag names, %q isn't one", key)
+		}
+	}
+	if len(s.Tags) > 0 && s.Query != "" {
+		return fmt.Errorf("tags can't be used with a query, filter in the query instead")
+	}
+	if len(s.Measurements) > 0 && (s.Compute != "" || s.Query != "") {
+		return fmt.Errorf("measurements can't be used with compute or a query")
+	}
+	if s.Accumulate {
+		if s.Compute != "" || s.Query != "" || s.Field == "" {
+			return fmt.Errorf("accumulate needs a field, it can't be used with compute or a query")
+		}
+		if (s.Aggregation != "" && s.Aggregation != "mean") || s.AggregateEvery != "" || (s.Window != "" && s.Window != "today") {
+			return fmt.Errorf("accumulate integrates the field since midnight, it can't have an aggregation, aggregate_every or window")
+		}
+		return validateComponent(s)
+	}
+	if s.RecentSamples < 0 || s.RecentSamples > maxRecentSamples {
+		return fmt.Errorf("recent_samples has to be from 0 to %d", maxRecentSamples)
+	}
+	if s.RecentSamples > 0 && (s.Query != "" || s.Compute != "" || s.Accumulate) {
+		return fmt.Errorf("recent_samples needs a field, it can't be used with a query, compute or accumulate")
+	}
+	switch s.Record {
+	case "", "last":
+	case "first":
+		if s.publishesArray() {
+			return fmt.Errorf("record first can't be used with window_values array, which publishes every record")
+		}
+	default:
+		return fmt.Errorf("unknown record %q, use first or last", s.Record)
+	}
+	if s.Expression != "" && s.Compute != "expression" {
+		return fmt.Errorf("expression needs \"compute\": \"expression\"")
+	}
+	if s.Compute != "" {
+		return validateCompute(s)
+	}
+	if s.Query != "" {
+		return validateComponent(s)
+	}
+	if s.Field == "" || s.Aggregation == "" {
+		return fmt.Errorf("needs a field and aggregation, or a query")
+	}
+	if !validAggregations[s.Aggregation] {
+		return fmt.Errorf("unsupported aggregation %q", s.Aggregation)
+	}
+	if s.Aggregation == "quantile" && (s.Quantile <= 0 || s.Quantile >= 1) {
+		return fmt.Errorf("quantile %g has to be between 0 and 1, e.g. 0.95 for the 95th percentile", s.Quantile)
+	}
+	if s.Aggregation != "quantile" && s.Quantile != 0 {
+		return fmt.Errorf("quantile is only used by the quantile aggregation")
+	}
+	if s.Aggregation == "increase" && s.AggregateEvery != "" {
+		return fmt.Errorf("increase can't be used with aggregate_every")
+	}
+	if s.Aggregation == "increase" && len(s.Measurements) > 1 {
+		return fmt.Errorf("increase can't combine measurements, each counter resets on its own")
+	}
+	if s.AggregateEvery != "" && !fluxDuration.MatchString(s.AggregateEvery) {
+		return fmt.Errorf("aggregate_every %q is not a Flux duration", s.AggregateEvery)
+	}
+	if s.Fill != "" && s.Fill != "previous" {
+		if _, err := strconv.ParseFloat(s.Fill, 64); err != nil {
+			return fmt.Errorf("fill %q is not previous or a number", s.Fill)
+		}
+	}
+	if err := validateSmoothing(s); err != nil {
+		return err
+	}
+	if err := validateComponent(s); err != nil {
+		return err
+	}
+	switch s.WindowValues {
+	case "", "last":
+	case "array":
+		if s.AggregateEvery == "" {
+			return fmt.Errorf("window_values array needs aggregate_every")
+		}
+	default:
+		return fmt.Errorf("unknown window_values %q", s.WindowValues)
+	}
+	return nil
+}
+
+// Check a Flux preamble only has import and option statements with balanced
+// brackets and quotes. This catches a query pasted into the preamble or a
+// missing quote, it isn't a Flux parser.
+func validatePreamble(preamble string) error {
+	for _, line := range strings.Split(preamble, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "//") || line != strings.TrimLeft(line, " \t") {
+			continue // Blank, comment or the continuation of a statement
+		}
+		if !strings.HasPrefix(trimmed, "import ") && !strings.HasPrefix(trimmed, "option ") {
+			return fmt.Errorf("line %q is not an import or option", trimmed)
+		}
+	}
+
+	var open []rune
+	inString := false
+	closing := map[rune]rune{')': '(', ']': '[', '}': '{'}
+	for i, r := range preamble {
+		switch {
+		case inString:
+			if r == '"' && (i == 0 || preamble[i-1] != '\\') {
+				inString = false
+			}
+		case r == '"':
+			inString = true
+		case r == '(' || r == '[' || r == '{':
+			open = append(open, r)
+		case closing[r] != 0:
+			if len(open) == 0 || open[len(open)-1] != closing[r] {
+				return fmt.Errorf("unbalanced %q", r)
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if inString {
+		return fmt.Errorf("unterminated string")
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("unclosed %q", open[len(open)-1])
+	}
+	return nil
+}
+
+// Check no two sensors share a place in the combined JSON payload, and no
+// group has the name of a top level key
+func validateJSONKeys(sensors []Sensor) error {
+	used := make(map[string]string)
+	groups := make(map[string]bool)
+	for _, s := range sensors {
+		if s.hasExternalTopic() {
+			continue
+		}
+		path := s.JSONGroup + "." + s.jsonKey()
+		if other, taken := used[path]; taken {
+			return fmt.Errorf("sensor %s: json key %s is already used by %s", s.Key, strings.TrimPrefix(path, "."), other)
+		}
+		used[path] = s.Key
+		if s.JSONGroup != "" {
+			groups[s.JSONGroup] = true
+		}
+	}
+	for path, key := range used {
+		if name, ok := strings.CutPrefix(path, "."); ok && groups[name] {
+			return fmt.Errorf("sensor %s: json key %s is also a json group", key, name)
+		}
+	}
+	return nil
+}
+
+func validateSmoothing(s Sensor) error {
+	if s.Smoothing == "" {
+		if s.SmoothingPeriod != "" || s.SmoothingEvery != "" {
+			return fmt.Errorf("smoothing_period needs smoothing")
+		}
+		return nil
+	}
+	if !smoothingFunctions[s.Smoothing] {
+		return fmt.Errorf("unsupported smoothing %q, use timedMovingAverage, movingAverage or exponentialMovingAverage", s.Smoothing)
+	}
+	if s.Aggregation == "increase" {
+		return fmt.Errorf("increase can't be smoothed")
+	}
+	if s.Smoothing == "timedMovingAverage" {
+		if !fluxDuration.MatchString(s.SmoothingPeriod) {
+			return fmt.Errorf("smoothing_period %q is not a Flux duration", s.SmoothingPeriod)
+		}
+		if s.SmoothingEvery != "" && !fluxDuration.MatchString(s.SmoothingEvery) {
+			return fmt.Errorf("smoothing_every %q is not a Flux duration", s.SmoothingEvery)
+		}
+		return nil
+	}
+	if n, err := strconv.Atoi(s.SmoothingPeriod); err != nil || n < 1 {
+		return fmt.Errorf("smoothing_period %q is not a number of points", s.SmoothingPeriod)
+	}
+	if s.SmoothingEvery != "" {
+		return fmt.Errorf("smoothing_every is only used by timedMovingAverage")
+	}
+	return nil
+}
+
+func validateCompute(s Sensor) error {
+	inputs, ok := computeInputs[s.Compute]
+	if s.Compute == "expression" {
+		var err error
+		if inputs, err = validateExpression(s.Expression); err != nil {
+			return fmt.Errorf("expression: %v", err)
+		}
+	} else if !ok {
+		return fmt.Errorf("unknown compute %q, use heat_index, wind_chill, feels_like, trend or expression", s.Compute)
+	}
+	if err := validateTrend(s); err != nil {
+		return err
+	}
+	if s.Query != "" || s.Field != "" || (s.Aggregation != "" && s.Aggregation != "last") || s.AggregateEvery != "" {
+		return fmt.Errorf("compute reads the last value of its inputs, it can't have a query, field, aggregation or aggregate_every")
+	}
+	for input := range s.Inputs {
+		if !slices.Contains(inputs, input) {
+			return fmt.Errorf("%s has no input %q", s.Compute, input)
+		}
+	}
+	return validateComponent(s)
+}
+
+func validateTrend(s Sensor) error {
+	if s.Compute != "trend" {
+		if s.TrendPeriod != "" || s.TrendThreshold != 0 || s.TrendHysteresis != 0 {
+			return fmt.Errorf("trend_period, trend_threshold and trend_hysteresis need \"compute\": \"trend\"")
+		}
+		return nil
+	}
+	if s.TrendPeriod != "" {
+		if period, err := time.ParseDuration(s.TrendPeriod); err != nil || period <= 0 {
+			return fmt.Errorf("trend_period %q is not a positive duration such as 3h", s.TrendPeriod)
+		}
+	}
+	if s.TrendThreshold < 0 || s.TrendHysteresis < 0 || s.TrendHysteresis > s.trendThreshold() {
+		return fmt.Errorf("trend_threshold and trend_hysteresis can't be negative and the hysteresis can't be above the threshold")
+	}
+	return nil
+}
+
+// Parse an expression and evaluate it with every variable 1, so a typo such
+// as an unknown function or operator fails at startup. Returns its variables.
+func validateExpression(source string) ([]string, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, fmt.Errorf("is empty")
+	}
+	expression, err := govaluate.NewEvaluableExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	vars := expressionVars(expression)
+	if len(vars) == 0 {
+		return nil, fmt.Errorf("has no inputs")
+	}
+	parameters := make(map[string]interface{}, len(vars))
+	for _, name := range vars {
+		parameters[name] = 1.0
+	}
+	if _, err := expression.Evaluate(parameters); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+func validateFormat(s Sensor) error {
+	switch s.Format {
+	case "":
+	case "cardinal":
+		if s.isBinary() || s.publishesArray() {
+			return fmt.Errorf("format cardinal can't be used with a binary_sensor or window_values array")
+		}
+	case "trend":
+		if s.Compute != "trend" {
+			return fmt.Errorf("format trend needs \"compute\": \"trend\"")
+		}
+	default:
+		return fmt.Errorf("unknown format %q", s.Format)
+	}
+	return nil
+}
+
+func validateComponent(s Sensor) error {
+	if err := validateFormat(s); err != nil {
+		return err
+	}
+	switch s.component() {
+	case "sensor":
+	case "binary_sensor":
+		if s.Threshold == nil {
+			return fmt.Errorf("binary_sensor needs a threshold")
+		}
+		if s.publishesArray() {
+			return fmt.Errorf("binary_sensor can't publish window_values array")
+		}
+	default:
+		return fmt.Errorf("unsupported component %q", s.Component)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateSensorIncrease(t *testing.T) {
+	counter := Sensor{Key: "rain-today", Name: "Rain Today", Field: "rain-counter", Aggregation: "increase"}
+	if err := validateSensor(counter); err != nil {
+		t.Fatalf("increase sensor rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Sensor)
+		want   string
+	}{
+		{"aggregate_every", func(s *Sensor) { s.AggregateEvery = "1h" }, "aggregate_every"},
+		{"several measurements", func(s *Sensor) { s.Measurements = []string{"a", "b"} }, "combine measurements"},
+		{"unknown aggregation", func(s *Sensor) { s.Aggregation = "increases" }, "unsupported aggregation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := counter
+			tt.change(&s)
+			err := validateSensor(s)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("validateSensor() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSmoothing(t *testing.T) {
+	tests := []struct {
+		name                     string
+		smoothing, period, every string
+		aggregation              string
+		want                     string // Part of the error, empty when valid
+	}{
+		{"timed", "timedMovingAverage", "10m", "1m", "max", ""},
+		{"points", "movingAverage", "5", "", "max", ""},
+		{"unknown function", "rollingMean", "5", "", "max", "unsupported smoothing"},
+		{"timed needs a duration", "timedMovingAverage", "5", "", "max", "not a Flux duration"},
+		{"points need a count", "movingAverage", "10m", "", "max", "not a number of points"},
+		{"period without smoothing", "", "10m", "", "max", "needs smoothing"},
+		{"increase", "movingAverage", "5", "", "increase", "can't be smoothed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Sensor{Smoothing: tt.smoothing, SmoothingPeriod: tt.period, SmoothingEvery: tt.every, Aggregation: tt.aggregation}
+			err := validateSmoothing(s)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("validateSmoothing() = %v, want nil", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("validateSmoothing() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSensorQuantile(t *testing.T) {
+	tests := []struct {
+		name        string
+		aggregation string
+		quantile    float64
+		want        string // Part of the error, empty when valid
+	}{
+		{"95th percentile", "quantile", 0.95, ""},
+		{"median", "quantile", 0.5, ""},
+		{"missing", "quantile", 0, "between 0 and 1"},
+		{"one", "quantile", 1, "between 0 and 1"},
+		{"percent", "quantile", 95, "between 0 and 1"},
+		{"negative", "quantile", -0.5, "between 0 and 1"},
+		{"other aggregation", "max", 0.95, "only used by the quantile aggregation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Sensor{Key: "wind-p95", Name: "Wind P95", Field: "wind", Aggregation: tt.aggregation, Quantile: tt.quantile}
+			err := validateSensor(s)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("validateSensor() = %v, want nil", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("validateSensor() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultSensorQueries(t *testing.T) {
+	loaded, err := readConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.sensors) != len(defaultSensors) {
+		t.Fatalf("%d sensors, want the %d built in ones", len(loaded.sensors), len(defaultSensors))
+	}
+	for _, sensor := range loaded.sensors {
+		query, _ := buildSensorQuery(sensor, "-1h", "")
+		for _, want := range []string{
+			`filter(fn: (r) => r._measurement == "sensor-data")`,
+			`filter(fn: (r) => r._field == "` + sensor.Field + `")`,
+			"|> " + sensor.Aggregation + "()",
+		} {
+			if !strings.Contains(query, want) {
+				t.Errorf("%s query has no %s:\n%s", sensor.Key, want, query)
+			}
+		}
+	}
+}
+
+func TestConfigSensorQueries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{
+		"fields": {"gust": {"measurement": "weewx", "field": "windGust"}},
+		"sensors": [
+			{"key": "gust", "name": "Wind Gust", "field": "gust", "aggregations": ["max", "mean"], "windows": ["10m", "today"],
+			 "device_class": "wind_speed", "unit": "km/h", "state_class": "measurement"}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(mappings map[string]FieldMapping, now func() time.Time) { fieldMappings, clock = mappings, now }(fieldMappings, clock)
+	fieldMappings = loaded.fieldMappings
+	clock = func() time.Time { return time.Date(2024, 6, 1, 15, 30, 0, 0, time.UTC) }
+
+	// Each aggregation and window is a sensor with a query of its own
+	want := map[string]struct{ name, aggregation, start string }{
+		"gust-max-10m":    {"Maximum Wind Gust 10m", "max", "-10m"},
+		"gust-max-today":  {"Maximum Wind Gust Today", "max", "2024-06-01T00:00:00Z"},
+		"gust-mean-10m":   {"Average Wind Gust 10m", "mean", "-10m"},
+		"gust-mean-today": {"Average Wind Gust Today", "mean", "2024-06-01T00:00:00Z"},
+	}
+	found := 0
+	for _, sensor := range loaded.sensors {
+		w, ok := want[sensor.Key]
+		if !ok {
+			continue
+		}
+		found++
+		if sensor.Name != w.name {
+			t.Errorf("%s name = %q, want %q", sensor.Key, sensor.Name, w.name)
+		}
+		query, _ := buildSensorQuery(sensor, rangeStart(sensor), "")
+		wantQuery := flux(`from(bucket: "`+influxBucket+`")`, "range(start: "+w.start+")", `filter(fn: (r) => r._measurement == "weewx")`,
+			`filter(fn: (r) => r._field == "windGust")`, w.aggregation+"()")
+		if query != wantQuery {
+			t.Errorf("%s query =\n%s\nwant\n%s", sensor.Key, query, wantQuery)
+		}
+	}
+	if found != len(want) {
+		t.Errorf("found %d of the %d expanded sensors", found, len(want))
+	}
+	// The built in sensors are still queried next to the config file's
+	if len(loaded.sensors) != len(defaultSensors)+len(want) {
+		t.Errorf("%d sensors, want %d", len(loaded.sensors), len(defaultSensors)+len(want))
+	}
+}
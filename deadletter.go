@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A state that a broker didn't accept, appended to DEAD_LETTER_FILE as a
+// JSON line
+type deadLetter struct {
+	Time   string `json:"time"`
+	Broker string `json:"broker"`
+	Topic  string `json:"topic"`
+	Value  string `json:"value"`
+	Error  string `json:"error"`
+}
+
+// Serialises the appends, publishes to several brokers can fail together
+var deadLetterMu sync.Mutex
+
+// Append a failed state publish to DEAD_LETTER_FILE, when it is set. A
+// failure to write it is only logged, it doesn't fail the loop.
+func recordDeadLetter(broker, topic string, payload interface{}, publishErr error) {
+	if deadLetterFile == "" {
+		return
+	}
+	var value string
+	switch p := payload.(type) {
+	case string:
+		value = p
+	case []byte:
+		value = string(p)
+	default:
+		value = fmt.Sprint(p)
+	}
+	line, err := json.Marshal(deadLetter{
+		Time:   time.Now().Format(time.RFC3339),
+		Broker: broker,
+		Topic:  topic,
+		Value:  value,
+		Error:  publishErr.Error(),
+	})
+	if err != nil {
+		log.Printf("Error marshalling dead letter for %s: %v", topic, err)
+		return
+	}
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	f, err := os.OpenFile(deadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		logThrottled("dead letter "+err.Error(), "Error opening %s: %v", deadLetterFile, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		logThrottled("dead letter "+err.Error(), "Error writing %s: %v", deadLetterFile, err)
+	}
+}
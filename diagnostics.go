@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Diagnostic sensor showing the last InfluxDB query error, or ok
+const errorSensorKey = "last-error"
+
+// Diagnostic sensor showing how far InfluxDB's clock is ahead of the bridge's
+const timeDriftSensorKey = "influx-time-drift"
+
+// Diagnostic sensor showing how many query attempts the last loop repeated
+const retrySensorKey = "query-retries"
+
+// Query attempts repeated in the current loop, counted from every query
+// worker
+var loopRetries atomic.Int64
+
+// Home Assistant rejects states longer than this
+const maxStateLength = 255
+
+type lastErrorState struct {
+	Message string `json:"message"`
+	Time    string `json:"time"`
+}
+
+func errorSensorConfig(device Device) MqttConfig {
+	stateTopic := fmt.Sprintf(mqttStateTopic, "sensor", mqttSensor, errorSensorKey)
+	config := MqttConfig{
+		Name:                "Last Query Error",
+		StateTopic:          stateTopic,
+		ValueTemplate:       "{{ value_json.message }}",
+		JSONAttributesTopic: stateTopic,
+		UniqueID:            fmt.Sprintf("%s-sensor-%s", mqttSensor, errorSensorKey),
+		ObjectID:            objectID(errorSensorKey),
+		ExpireAfter:         int(expireAfter.Seconds()),
+		EntityCategory:      "diagnostic",
+		Icon:                "mdi:database-alert",
+		Device:              device,
+	}
+	setAvailability(&config)
+	return config
+}
+
+// Publish the loop's last query error, or ok when every query succeeded. The
+// message is sent as a JSON string so any error text is safe in the template.
+func publishLastError(conns []*mqttConnection, err error) {
+	message := "ok"
+	if err != nil {
+		message = strings.Join(strings.Fields(err.Error()), " ")
+		if runes := []rune(message); len(runes) > maxStateLength {
+			message = string(runes[:maxStateLength-3]) + "..."
+		}
+	}
+
+	payload, marshalErr := json.Marshal(lastErrorState{Message: message, Time: time.Now().Format(time.RFC3339)})
+	if marshalErr != nil {
+		log.Printf("Error marshalling last error: %v", marshalErr)
+		return
+	}
+	topic := fmt.Sprintf(mqttStateTopic, "sensor", mqttSensor, errorSensorKey)
+	if publishErr := publishToMQTT(conns, topic, string(payload)); publishErr != nil {
+		log.Printf("Error publishing last error: %v", publishErr)
+	}
+}
+
+func timeDriftSensorConfig(device Device) MqttConfig {
+	config := MqttConfig{
+		DeviceClass:       "duration",
+		Name:              "InfluxDB Time Drift",
+		StateTopic:        fmt.Sprintf(mqttStateTopic, "sensor", mqttSensor, timeDriftSensorKey),
+		StateClass:        "measurement",
+		UnitOfMeasurement: "s",
+		UniqueID:          fmt.Sprintf("%s-sensor-%s", mqttSensor, timeDriftSensorKey),
+		ObjectID:          objectID(timeDriftSensorKey),
+		ExpireAfter:       int(expireAfter.Seconds()),
+		EntityCategory:    "diagnostic",
+		Icon:              "mdi:clock-alert-outline",
+		Device:            device,
+	}
+	setAvailability(&config)
+	return config
+}
+
+// Query InfluxDB's now() and return how many seconds it is ahead of the
+// local clock, compared with the middle of the request so the round trip
+// doesn't count as drift
+func queryTimeDrift(ctx context.Context) (float64, error) {
+	client := newInfluxClient()
+	defer client.Close()
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	sent := time.Now()
+	result, err := client.QueryAPI(influxOrg).Query(ctx, `import "array"
+
+array.from(rows: [{_value: now()}])`)
+	if err != nil {
+		return 0, err
+	}
+	defer result.Close()
+	var server time.Time
+	for result.Next() {
+		if t, ok := result.Record().Value().(time.Time); ok {
+			server = t
+		}
+	}
+	received := time.Now()
+	if result.Err() != nil {
+		return 0, result.Err()
+	}
+	if server.IsZero() {
+		return 0, fmt.Errorf("no time in the result")
+	}
+	local := sent.Add(received.Sub(sent) / 2)
+	return server.Sub(local).Seconds(), nil
+}
+
+// Publish the time drift. A failed query is logged and publishes nothing,
+// the sensor then keeps its last value.
+func publishTimeDrift(ctx context.Context, conns []*mqttConnection) {
+	drift, err := queryTimeDrift(ctx)
+	if err != nil {
+		logThrottled("time drift "+err.Error(), "Error querying InfluxDB time: %v", err)
+		return
+	}
+	warnClockSkew(drift)
+	topic := fmt.Sprintf(mqttStateTopic, "sensor", mqttSensor, timeDriftSensorKey)
+	if err := publishToMQTT(conns, topic, strconv.FormatFloat(drift, 'f', 1, 64)); err != nil {
+		log.Printf("Error publishing time drift: %v", err)
+	}
+}
+
+func retrySensorConfig(device Device) MqttConfig {
+	config := MqttConfig{
+		Name:           "Query Retries",
+		StateTopic:     fmt.Sprintf(mqttStateTopic, "sensor", mqttSensor, retrySensorKey),
+		StateClass:     "measurement",
+		UniqueID:       fmt.Sprintf("%s-sensor-%s", mqttSensor, retrySensorKey),
+		ObjectID:       objectID(retrySensorKey),
+		ExpireAfter:    int(expireAfter.Seconds()),
+		EntityCategory: "diagnostic",
+		Icon:           "mdi:database-refresh",
+		Device:         device,
+	}
+	setAvailability(&config)
+	return config
+}
+
+// Publish the number of query attempts the loop repeated
+func publishRetries(conns []*mqttConnection) {
+	topic := fmt.Sprintf(mqttStateTopic, "sensor", mqttSensor, retrySensorKey)
+	if err := publishToMQTT(conns, topic, strconv.FormatInt(loopRetries.Load(), 10)); err != nil {
+		log.Printf("Error publishing query retries: %v", err)
+	}
+}
+
+// Compare the bridge's clock with InfluxDB's at startup, a container with a
+// drifting clock shifts every since midnight window and daily total
+func checkClockSkew() {
+	if maxClockSkew <= 0 {
+		return
+	}
+	drift, err := queryTimeDrift(context.Background())
+	if err != nil {
+		log.Printf("Warning: couldn't compare the clock with InfluxDB's: %v", err)
+		return
+	}
+	if !warnClockSkew(drift) {
+		log.Printf("Clock is within %s of InfluxDB's (%.1fs)", maxClockSkew, drift)
+	}
+}
+
+// Log a warning when the drift is over MAX_CLOCK_SKEW, reporting whether it was
+func warnClockSkew(drift float64) bool {
+	if maxClockSkew <= 0 || math.Abs(drift) <= maxClockSkew.Seconds() {
+		return false
+	}
+	log.Printf("Warning: InfluxDB's clock is %.1fs off the bridge's, midnight windows won't line up. Check the host's time sync (NTP).", drift)
+	return true
+}
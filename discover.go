@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// Print the fields stored in each measurement the sensors read from. Returns
+// the exit code.
+func discoverFields(w io.Writer) int {
+	client := newInfluxClient()
+	defer client.Close()
+	queryAPI := client.QueryAPI(influxOrg)
+
+	measurements := []string{influxMeasurement}
+	for _, mapping := range fieldMappings {
+		if mapping.Measurement != "" && !slices.Contains(measurements, mapping.Measurement) {
+			measurements = append(measurements, mapping.Measurement)
+		}
+	}
+	for _, sensor := range sensors {
+		for _, measurement := range sensor.Measurements {
+			if !slices.Contains(measurements, measurement) {
+				measurements = append(measurements, measurement)
+			}
+		}
+	}
+
+	failed := false
+	for _, measurement := range measurements {
+		query := fmt.Sprintf(`import "influxdata/influxdb/schema"
+
+schema.measurementFieldKeys(bucket: "%s", measurement: "%s", start: -30d)`, influxBucket, measurement)
+
+		ctx, cancel := queryContext(context.Background())
+		fields, err := readStrings(ctx, queryAPI, query)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(w, "%s: %v\n", measurement, err)
+			failed = true
+			continue
+		}
+
+		fmt.Fprintf(w, "%s (bucket %s, last 30 days):\n", measurement, influxBucket)
+		if len(fields) == 0 {
+			fmt.Fprintln(w, "  no fields")
+		}
+		for _, field := range fields {
+			fmt.Fprintf(w, "  %s\n", field)
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// Run a query and read the string _value of every record
+func readStrings(ctx context.Context, queryAPI api.QueryAPI, query string) ([]string, error) {
+	result, err := runQuery(ctx, queryAPI, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var values []string
+	for result.Next() {
+		if v, ok := result.Record().Value().(string); ok {
+			values = append(values, v)
+		}
+	}
+	return values, result.Err()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Errors of the query layer, for callers to match with errors.Is. A failed
+// query returns a *QueryError, which matches ErrQuery and its Kind.
+var (
+	ErrNoData  = errors.New("no data")
+	ErrAuth    = errors.New("InfluxDB token rejected")
+	ErrTimeout = errors.New("InfluxDB query timed out")
+	ErrQuery   = errors.New("InfluxDB query failed")
+)
+
+// A query that failed, wrapping the error from the InfluxDB client
+type QueryError struct {
+	Name    string // Sensor or query, e.g. rain recent samples
+	Kind    error  // ErrAuth, ErrTimeout or ErrQuery
+	Message string // What went wrong, e.g. InfluxDB rejected the rain query
+	Err     error
+}
+
+func (e *QueryError) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+func (e *QueryError) Is(target error) bool {
+	return target == ErrQuery || target == e.Kind
+}
+
+// Whether a query attempt ran out of time, INFLUX_QUERY_TIMEOUT's or the
+// HTTP client's
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Short reason of a query error, for metric labels
+func queryErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrAuth):
+		return "auth"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	}
+	return "query"
+}
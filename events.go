@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// A bridge lifecycle event, published to EVENT_TOPIC
+type bridgeEvent struct {
+	Event   string `json:"event"`
+	Version string `json:"version"`
+	Time    string `json:"time"`
+}
+
+// Publish a start or stop event when EVENT_TOPIC is set. Events aren't
+// retained, subscribers see every restart rather than the last one. The stop
+// event is sent once, retrying it would eat into docker's 10s stop grace
+// period before offline is published.
+func publishEvent(conns []*mqttConnection, event string) {
+	if eventTopic == "" {
+		return
+	}
+	payload, err := json.Marshal(bridgeEvent{Event: event, Version: version, Time: time.Now().Format(time.RFC3339)})
+	if err != nil {
+		log.Printf("Error marshalling %s event: %v", event, err)
+		return
+	}
+	publish := publishAllWithRetry
+	if event == "stop" {
+		publish = publishConnected
+	}
+	if err := publish(conns, eventTopic, 1, false, payload); err != nil {
+		log.Printf("Error publishing %s event: %v", event, err)
+		return
+	}
+	log.Printf("Published to %s: %s", eventTopic, payload)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestStopEventIsNotRetried(t *testing.T) {
+	setPublishTimeout(t, 200*time.Millisecond)
+	defer func(topic string) { eventTopic = topic }(eventTopic)
+	eventTopic = "bridge/events"
+
+	published := make(chan brokerMessage, 10)
+	target := mqttTarget{Broker: fakeBroker(t, published), ClientID: "bridge-test"}
+	client := mqtt.NewClient(newMqttOptions(target))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	up := &mqttConnection{target: target, client: client}
+
+	// One broker never acknowledges, one was never connected
+	stalled := silentConnection(t)
+	downTarget := mqttTarget{Broker: "tcp://127.0.0.1:1", ClientID: "bridge-test"}
+	down := &mqttConnection{target: downTarget, client: mqtt.NewClient(newMqttOptions(downTarget))}
+
+	start := time.Now()
+	publishEvent([]*mqttConnection{stalled, down, up}, "stop")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stop event took %s, want a single %s attempt", elapsed, publishTimeout)
+	}
+	select {
+	case got := <-published:
+		if got.topic != eventTopic {
+			t.Errorf("published to %s, want %s", got.topic, eventTopic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stop event not published to the connected broker")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Print the discovery configs as a manual mqtt: block for configuration.yaml,
+// for users who have discovery turned off
+func exportHAYAML(w io.Writer) {
+	byComponent := map[string][]MqttConfig{}
+	var components []string
+	for _, entry := range discoveryConfigs() {
+		if _, ok := byComponent[entry.Component]; !ok {
+			components = append(components, entry.Component)
+		}
+		byComponent[entry.Component] = append(byComponent[entry.Component], entry.Config)
+	}
+
+	fmt.Fprintln(w, "mqtt:")
+	for _, component := range components {
+		fmt.Fprintf(w, "  %s:\n", component)
+		for _, config := range byComponent[component] {
+			writeYAMLFields(w, reflect.ValueOf(config), "    - ", "      ")
+		}
+	}
+}
+
+// Write the fields of a struct as yaml keys named by their json tags. Empty
+// strings are left out too, as home assistant's yaml schema rejects them for
+// keys such as device_class. first prefixes the first line and indent the rest
+func writeYAMLFields(w io.Writer, v reflect.Value, first, indent string) {
+	prefix := first
+	for i := 0; i < v.NumField(); i++ {
+		name, opts, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		field := v.Field(i)
+		if (opts == "omitempty" || field.Kind() == reflect.String) && field.IsZero() {
+			continue
+		}
+		if field.Kind() == reflect.Pointer {
+			field = field.Elem()
+		}
+
+		switch field.Kind() {
+		case reflect.Struct:
+			fmt.Fprintf(w, "%s%s:\n", prefix, name)
+			writeYAMLFields(w, field, indent+"  ", indent+"  ")
+		default:
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, name, yamlValue(field))
+		}
+		prefix = indent
+	}
+}
+
+// A scalar, or a list such as the device's identifiers or a map such as an
+// availability topic in flow style
+func yamlValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Struct:
+		var items []string
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+			if !v.Field(i).IsZero() {
+				items = append(items, name+": "+yamlValue(v.Field(i)))
+			}
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case reflect.Slice, reflect.Array:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = yamlValue(v.Index(i))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
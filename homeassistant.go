@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// How long to wait for each reply from Home Assistant
+const homeAssistantTimeout = 30 * time.Second
+
+// How far before the first imported day to look for the sum the imported
+// totals continue from. Home Assistant compiles a statistic every hour, a
+// week covers the entity being unavailable for a while.
+const existingSumLookback = 7 * 24 * time.Hour
+
+// A connection to Home Assistant's websocket API, which --backfill-days
+// imports past days into the long term statistics with
+type homeAssistant struct {
+	conn *websocket.Conn
+	id   int // Of the last command sent
+}
+
+// The fields of the websocket API's messages the bridge reads
+type haMessage struct {
+	ID      int             `json:"id"`
+	Type    string          `json:"type"`
+	Success bool            `json:"success"`
+	Result  json.RawMessage `json:"result"`
+	Message string          `json:"message"` // Why authentication failed
+	Error   *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Connect to Home Assistant at haURL, e.g. http://homeassistant.local:8123,
+// and authenticate with a long-lived access token
+func dialHomeAssistant(haURL, token string) (*homeAssistant, error) {
+	u, err := url.Parse(haURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, use http or https", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/websocket"
+
+	config, err := websocket.NewConfig(u.String(), haURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ha := &homeAssistant{conn: conn}
+	if err := ha.authenticate(token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ha, nil
+}
+
+func (ha *homeAssistant) authenticate(token string) error {
+	var msg haMessage
+	if err := ha.receive(&msg); err != nil {
+		return err
+	}
+	if msg.Type != "auth_required" {
+		return fmt.Errorf("expected auth_required, got %s", msg.Type)
+	}
+	if err := websocket.JSON.Send(ha.conn, map[string]string{"type": "auth", "access_token": token}); err != nil {
+		return err
+	}
+	if err := ha.receive(&msg); err != nil {
+		return err
+	}
+	if msg.Type != "auth_ok" {
+		return fmt.Errorf("authentication failed: %s", msg.Message)
+	}
+	return nil
+}
+
+func (ha *homeAssistant) receive(msg *haMessage) error {
+	ha.conn.SetReadDeadline(time.Now().Add(homeAssistantTimeout))
+	*msg = haMessage{}
+	return websocket.JSON.Receive(ha.conn, msg)
+}
+
+// Send a command and wait for its result
+func (ha *homeAssistant) call(command map[string]interface{}) (json.RawMessage, error) {
+	ha.id++
+	command["id"] = ha.id
+	if err := websocket.JSON.Send(ha.conn, command); err != nil {
+		return nil, err
+	}
+	for {
+		var msg haMessage
+		if err := ha.receive(&msg); err != nil {
+			return nil, err
+		}
+		// Anything but the command's result is skipped
+		if msg.ID != ha.id || msg.Type != "result" {
+			continue
+		}
+		if msg.Success {
+			return msg.Result, nil
+		}
+		if msg.Error != nil {
+			return nil, fmt.Errorf("%s: %s", msg.Error.Code, msg.Error.Message)
+		}
+		return nil, errors.New("command failed")
+	}
+}
+
+// The sum of a statistic at start, from the last hourly statistic in the
+// existingSumLookback before it. Zero when there is none, the statistic then
+// starts with the imported rows.
+func (ha *homeAssistant) existingSum(statisticID string, start time.Time) (float64, error) {
+	result, err := ha.call(map[string]interface{}{
+		"type":          "recorder/statistics_during_period",
+		"start_time":    start.Add(-existingSumLookback).Format(time.RFC3339),
+		"end_time":      start.Format(time.RFC3339),
+		"statistic_ids": []string{statisticID},
+		"period":        "hour",
+		"types":         []string{"sum"},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var statistics map[string][]struct {
+		Sum *float64 `json:"sum"`
+	}
+	if err := json.Unmarshal(result, &statistics); err != nil {
+		return 0, fmt.Errorf("reading statistics: %w", err)
+	}
+	rows := statistics[statisticID]
+	for i := len(rows) - 1; i >= 0; i-- {
+		if rows[i].Sum != nil {
+			return *rows[i].Sum, nil
+		}
+	}
+	return 0, nil
+}
+
+func (ha *homeAssistant) Close() error {
+	return ha.conn.Close()
+}
+
+// An hour of long term statistics. Measurements have a mean, min and max,
+// totals a state and the sum of every state since the first.
+type statisticRow struct {
+	Start     string   `json:"start"`
+	Mean      *float64 `json:"mean,omitempty"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	State     *float64 `json:"state,omitempty"`
+	Sum       *float64 `json:"sum,omitempty"`
+	LastReset string   `json:"last_reset,omitempty"`
+}
+
+// Import a sensor's daily values into its entity's long term statistics,
+// each day as the hour starting at its midnight. The sums of totals carry on
+// from the one Home Assistant has at the first day.
+func (ha *homeAssistant) importStatistics(sensor Sensor, days []backfillRecord) error {
+	if len(days) == 0 {
+		return nil
+	}
+	total := sensor.StateClass == "total" || sensor.StateClass == "total_increasing"
+	var sum float64
+	if total {
+		start, err := time.Parse(time.RFC3339, days[0].Start)
+		if err != nil {
+			return err
+		}
+		if sum, err = ha.existingSum(sensor.entityID(), start); err != nil {
+			return fmt.Errorf("reading the existing sum: %w", err)
+		}
+	}
+
+	var rows []statisticRow
+	for _, day := range days {
+		value := day.number
+		row := statisticRow{Start: day.Start}
+		if total {
+			sum += value
+			runningSum := sum
+			row.State, row.Sum = &value, &runningSum
+			if sensor.StateClass == "total" {
+				row.LastReset = day.Start // Each day's total starts from 0
+			}
+		} else {
+			row.Mean, row.Min, row.Max = &value, &value, &value
+		}
+		rows = append(rows, row)
+	}
+
+	_, err := ha.call(map[string]interface{}{
+		"type": "recorder/import_statistics",
+		"metadata": map[string]interface{}{
+			"has_mean":            !total,
+			"has_sum":             total,
+			"name":                nil, // The entity's name
+			"source":              "recorder",
+			"statistic_id":        sensor.entityID(),
+			"unit_of_measurement": sensor.Unit,
+		},
+		"stats": rows,
+	})
+	return err
+}
+
+// The entity ID Home Assistant gives the sensor, from its discovery object_id
+func (s Sensor) entityID() string {
+	return s.component() + "." + objectID(s.Key)
+}
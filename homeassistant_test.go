@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/websocket"
+)
+
+// A Home Assistant accepting token, sending each command it gets to commands
+// and answering it with the fields answer returns for it
+func fakeHomeAssistant(t *testing.T, commands chan<- map[string]interface{}, answer func(command map[string]interface{}) map[string]interface{}) string {
+	t.Helper()
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		websocket.JSON.Send(conn, map[string]string{"type": "auth_required", "ha_version": "2025.3.0"})
+		var auth map[string]string
+		if err := websocket.JSON.Receive(conn, &auth); err != nil {
+			return
+		}
+		if auth["type"] != "auth" || auth["access_token"] != "token" {
+			websocket.JSON.Send(conn, map[string]string{"type": "auth_invalid", "message": "Invalid access token or password"})
+			return
+		}
+		websocket.JSON.Send(conn, map[string]string{"type": "auth_ok"})
+		for {
+			var command map[string]interface{}
+			if err := websocket.JSON.Receive(conn, &command); err != nil {
+				return
+			}
+			commands <- command
+			reply := map[string]interface{}{"id": command["id"], "type": "result"}
+			if answer != nil {
+				for k, v := range answer(command) {
+					reply[k] = v
+				}
+			}
+			websocket.JSON.Send(conn, reply)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestDialHomeAssistant(t *testing.T) {
+	url := fakeHomeAssistant(t, make(chan map[string]interface{}, 1), nil)
+	if _, err := dialHomeAssistant(url, "wrong"); err == nil || !strings.Contains(err.Error(), "Invalid access token") {
+		t.Errorf("dialHomeAssistant() with a wrong token = %v, want the authentication error", err)
+	}
+	if _, err := dialHomeAssistant("ftp://homeassistant.local", "token"); err == nil {
+		t.Error("dialHomeAssistant() with an ftp url = nil, want an error")
+	}
+}
+
+func TestImportStatisticsError(t *testing.T) {
+	commands := make(chan map[string]interface{}, 1)
+	url := fakeHomeAssistant(t, commands, func(map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"success": false,
+			"error":   map[string]string{"code": "home_assistant_error", "message": "Invalid timestamp"},
+		}
+	})
+	ha, err := dialHomeAssistant(url, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ha.Close()
+
+	sensor := Sensor{Key: "temperature-max", Unit: "°C", StateClass: "measurement"}
+	err = ha.importStatistics(sensor, []backfillRecord{{Start: "2025-03-09T00:30:00+13:00", number: 24.1}})
+	if err == nil || err.Error() != "home_assistant_error: Invalid timestamp" {
+		t.Errorf("importStatistics() = %v, want Home Assistant's error", err)
+	}
+}
+
+func TestBackfillImportsStatistics(t *testing.T) {
+	commands := make(chan map[string]interface{}, 10)
+	url := fakeHomeAssistant(t, commands, existingStatistics("sensor.influx_import_rain", 100))
+	server := fakeInflux(t, nil)
+	published := make(chan brokerMessage, 10)
+	target := mqttTarget{Broker: fakeBroker(t, published), ClientID: "bridge-test"}
+	client := mqtt.NewClient(newMqttOptions(target))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	defer func(current []Sensor, now func() time.Time, influx, ha, token string) {
+		sensors, clock, influxQueryURL, haURL, haToken = current, now, influx, ha, token
+	}(sensors, clock, influxQueryURL, haURL, haToken)
+	sensors = []Sensor{
+		{Key: "rain", Field: "rain", Aggregation: "sum", Unit: "mm", StateClass: "total_increasing"},
+		{Key: "rain-count", Field: "rain", Aggregation: "count"}, // No statistics without a state class
+	}
+	clock = func() time.Time { return time.Date(2025, 3, 10, 15, 0, 0, 0, time.UTC) }
+	influxQueryURL, haURL, haToken = server.URL, url, "token"
+
+	if err := runBackfill([]*mqttConnection{{target: target, client: client}}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 4 {
+		t.Errorf("%d backfill publishes, want 2 days of 2 sensors", len(published))
+	}
+	if len(commands) != 2 {
+		t.Fatalf("%d commands, want the existing sum and one import", len(commands))
+	}
+
+	got, _ := json.Marshal(<-commands)
+	want := `{"end_time":"2025-03-08T00:00:00Z","id":1,"period":"hour","start_time":"2025-03-01T00:00:00Z",` +
+		`"statistic_ids":["sensor.influx_import_rain"],"type":"recorder/statistics_during_period","types":["sum"]}`
+	if string(got) != want {
+		t.Errorf("statistics query =\n%s\nwant\n%s", got, want)
+	}
+
+	// Each query's last record is 4, the sum carries on from the existing
+	// one across the days
+	got, _ = json.Marshal(<-commands)
+	want = `{"id":2,"metadata":{"has_mean":false,"has_sum":true,"name":null,"source":"recorder","statistic_id":"sensor.influx_import_rain","unit_of_measurement":"mm"},` +
+		`"stats":[{"start":"2025-03-08T00:00:00Z","state":4,"sum":104},{"start":"2025-03-09T00:00:00Z","state":4,"sum":108}],"type":"recorder/import_statistics"}`
+	if string(got) != want {
+		t.Errorf("import =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// Answers a statistics query with hourly sums ending at sum, and every other
+// command with success
+func existingStatistics(statisticID string, sum float64) func(map[string]interface{}) map[string]interface{} {
+	return func(command map[string]interface{}) map[string]interface{} {
+		if command["type"] != "recorder/statistics_during_period" {
+			return map[string]interface{}{"success": true}
+		}
+		rows := []map[string]interface{}{
+			{"start": 1741392000000, "end": 1741395600000, "sum": sum - 1},
+			{"start": 1741395600000, "end": 1741399200000, "sum": sum},
+		}
+		return map[string]interface{}{"success": true, "result": map[string]interface{}{statisticID: rows}}
+	}
+}
+
+func TestExistingSum(t *testing.T) {
+	url := fakeHomeAssistant(t, make(chan map[string]interface{}, 1), func(map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"success": true, "result": map[string]interface{}{}}
+	})
+	ha, err := dialHomeAssistant(url, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ha.Close()
+
+	// Without statistics before the first day the sum starts from 0
+	sum, err := ha.existingSum("sensor.influx_import_rain", time.Date(2025, 3, 8, 0, 0, 0, 0, time.UTC))
+	if err != nil || sum != 0 {
+		t.Errorf("existingSum() without statistics = %v, %v, want 0", sum, err)
+	}
+}
+
+func TestBackfillReportsFailedPublishes(t *testing.T) {
+	server := fakeInflux(t, nil)
+	defer func(current []Sensor, influx, ha string) { sensors, influxQueryURL, haURL = current, influx, ha }(sensors, influxQueryURL, haURL)
+	sensors = []Sensor{{Key: "rain", Field: "rain", Aggregation: "sum"}}
+	influxQueryURL, haURL = server.URL, ""
+
+	// A broker that was never connected to
+	target := mqttTarget{Broker: "tcp://127.0.0.1:1", ClientID: "bridge-test"}
+	conns := []*mqttConnection{{target: target, client: mqtt.NewClient(newMqttOptions(target))}}
+	err := runBackfill(conns, 2)
+	if err == nil || !strings.Contains(err.Error(), "2 failures") {
+		t.Errorf("runBackfill() = %v, want both days' publishes failed", err)
+	}
+}
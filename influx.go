@@ -0,0 +1,648 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	ihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+)
+
+// Create an InfluxDB client for queries, to INFLUX_QUERY_URL when set (e.g. a
+// read replica) or INFLUX_URL. A unix:// URL connects over a Unix domain
+// socket, e.g. unix:///var/run/influxdb/influxdb.sock
+func newInfluxClient() influxdb2.Client {
+	opts := influxdb2.DefaultOptions()
+	serverURL := influxQueryURL
+
+	// The client takes whole seconds, round up so short timeouts aren't zero
+	opts.SetHTTPRequestTimeout(uint((influxHTTPTimeout + time.Second - 1) / time.Second))
+
+	if socket, ok := strings.CutPrefix(influxQueryURL, "unix://"); ok {
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		opts.SetHTTPClient(&http.Client{
+			Timeout: time.Duration(opts.HTTPRequestTimeout()) * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		})
+		// The host is ignored by the dialer but the client needs an HTTP URL
+		serverURL = "http://localhost"
+	}
+
+	if !influxGzip {
+		client := opts.HTTPClient()
+		if transport, ok := client.Transport.(*http.Transport); ok {
+			// Otherwise the transport asks for gzip itself
+			transport.DisableCompression = true
+		}
+		client.Transport = identityEncoding{client.Transport}
+	}
+
+	return influxdb2.NewClientWithOptions(serverURL, influxQueryToken, opts)
+}
+
+// Drops the Accept-Encoding: gzip the query API always sends, so influxdb
+// replies uncompressed
+type identityEncoding struct{ http.RoundTripper }
+
+func (t identityEncoding) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Del("Accept-Encoding")
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// Query InfluxDB for a sensor's data over its window. Sensors with an
+// aggregate window get one value per window, oldest first. A query without
+// rows returns ErrNoData.
+func queryInfluxDB(ctx context.Context, sensor Sensor) ([]float64, error) {
+	if sensor.Compute != "" {
+		values, err := queryComputed(ctx, sensor)
+		return sensor.clamp(sensor.convert(values)), err
+	}
+	if sensor.Accumulate {
+		values, err := queryAccumulated(ctx, sensor)
+		return sensor.clamp(sensor.convert(values)), err
+	}
+	if sensor.Query != "" {
+		log.Printf("Querying InfluxDB with the custom query for %s...\n", sensor.Key)
+	} else {
+		log.Printf("Querying InfluxDB for %s of %s data...\n", sensor.Aggregation, sensor.Field)
+	}
+	start, stop := queryRangeStart(sensor), queryStop
+	if values, ok := cachedResult(sensor, start); ok {
+		log.Printf("Using the cached result for %s", sensor.Key)
+		return sensorResult(sensor, values)
+	}
+	if stop == "" && windowStop == "latest-data" && sensor.Query == "" {
+		stop = latestDataStop(ctx, sensor, start)
+	}
+	query, params := buildSensorQuery(sensor, start, stop)
+	values, err := sensor.queryRecords(ctx, query, params)
+	if err != nil {
+		return nil, err
+	}
+	values = sensor.convert(values)
+	if sensor.Delta && len(values) > 0 {
+		values = sensor.delta(values)
+	}
+	values = sensor.clamp(values)
+	cacheResult(sensor, start, values)
+	return sensorResult(sensor, values)
+}
+
+// A sensor's values, or ErrNoData when the query returned no rows
+func sensorResult(sensor Sensor, values []float64) ([]float64, error) {
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%s: %w", sensor.Key, ErrNoData)
+	}
+	return values, nil
+}
+
+// With WINDOW_STOP=latest-data, the range stop just after the sensor field's
+// latest point, found with an extra query. Empty (now) when there is no data
+// in the range or the query fails.
+func latestDataStop(ctx context.Context, sensor Sensor, start string) string {
+	measurements, field := sensor.source()
+	query := withPreamble(sensor, buildFluxQuery(fluxQuery{
+		Bucket:       influxBucket,
+		Measurements: measurements,
+		Field:        field,
+		Tags:         sensor.Tags,
+		Aggregation:  "last",
+		RangeStart:   start,
+	}))
+
+	client := newInfluxClient()
+	defer client.Close()
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	result, err := client.QueryAPI(influxOrg).Query(ctx, query)
+	if err != nil {
+		logThrottled("latest "+err.Error(), "Error querying latest %s time, stopping at now: %v", sensor.Field, err)
+		return ""
+	}
+	defer result.Close()
+	var latest time.Time
+	for result.Next() {
+		if t := result.Record().Time(); t.After(latest) {
+			latest = t
+		}
+	}
+	if result.Err() != nil || latest.IsZero() {
+		return ""
+	}
+	// The range stop is exclusive
+	return latest.Add(time.Nanosecond).Format(time.RFC3339Nano)
+}
+
+// The start of the range queried in the publish loop, QUERY_START or the
+// bridge start with QUERY_WINDOW=since-start when set
+func queryRangeStart(sensor Sensor) string {
+	if queryStart != "" {
+		return queryStart
+	}
+	if queryWindow == "since-start" {
+		return bridgeStart.Format(time.RFC3339)
+	}
+	return rangeStart(sensor)
+}
+
+// Moving average functions a sensor can be smoothed with
+var smoothingFunctions = map[string]bool{"timedMovingAverage": true, "movingAverage": true, "exponentialMovingAverage": true}
+
+// The moving average call for a validated smoothing setting
+func smoothingStage(q fluxQuery) string {
+	if q.Smoothing == "timedMovingAverage" {
+		every := q.SmoothingEvery
+		if every == "" {
+			every = "1m"
+		}
+		return fmt.Sprintf("timedMovingAverage(every: %s, period: %s)", every, q.SmoothingPeriod)
+	}
+	return fmt.Sprintf("%s(n: %s)", q.Smoothing, q.SmoothingPeriod)
+}
+
+// The fill() call for a validated fill setting. A value is written as a float
+// literal since it has to match the type of _value.
+func fillStage(fill string) string {
+	if fill == "previous" {
+		return "fill(usePrevious: true)"
+	}
+	value, _ := strconv.ParseFloat(fill, 64)
+	return fmt.Sprintf("fill(value: %s)", floatLiteral(value))
+}
+
+// A Flux float literal, which needs a decimal point to compare or fill
+// float fields
+func floatLiteral(value float64) string {
+	literal := strconv.FormatFloat(value, 'f', -1, 64)
+	if !strings.ContainsAny(literal, ".eE") {
+		literal += ".0"
+	}
+	return literal
+}
+
+// The filter() for the query's measurements. With query parameters the
+// first is params.measurement, the others params.measurement2 and so on.
+func measurementStage(q fluxQuery) string {
+	conditions := make([]string, len(q.Measurements))
+	for i, measurement := range q.Measurements {
+		name := "measurement"
+		if i > 0 {
+			name += strconv.Itoa(i + 1)
+		}
+		conditions[i] = "r._measurement == " + q.stringArg(name, measurement)
+	}
+	return fmt.Sprintf("filter(fn: (r) => %s)", strings.Join(conditions, " or "))
+}
+
+// The filter() for the query's tag values, in key order. With query
+// parameters the values are params.tag, params.tag2 and so on.
+func tagStage(q fluxQuery) string {
+	keys := slices.Sorted(maps.Keys(q.Tags))
+	conditions := make([]string, len(keys))
+	for i, key := range keys {
+		name := "tag"
+		if i > 0 {
+			name += strconv.Itoa(i + 1)
+		}
+		conditions[i] = fmt.Sprintf("r[%q] == %s", key, q.stringArg(name, q.Tags[key]))
+	}
+	return fmt.Sprintf("filter(fn: (r) => %s)", strings.Join(conditions, " and "))
+}
+
+// The filter() dropping points outside the valid range
+func validRangeStage(q fluxQuery) string {
+	var conditions []string
+	if q.ValidMin != nil {
+		conditions = append(conditions, "r._value >= "+floatLiteral(*q.ValidMin))
+	}
+	if q.ValidMax != nil {
+		conditions = append(conditions, "r._value <= "+floatLiteral(*q.ValidMax))
+	}
+	return fmt.Sprintf("filter(fn: (r) => %s)", strings.Join(conditions, " and "))
+}
+
+// A sensor's custom query with its placeholders filled in, or the query
+// generated from its field and aggregation. An empty stop queries up to now.
+// With INFLUX_QUERY_PARAMS the generated query's bucket, measurement, field
+// and absolute times are returned as parameters instead.
+func buildSensorQuery(sensor Sensor, start, stop string) (string, map[string]interface{}) {
+	query, params := buildSensorQueryBody(sensor, start, stop)
+	return withPreamble(sensor, query), params
+}
+
+// Put the config file's and the sensor's Flux preambles before a query
+func withPreamble(sensor Sensor, query string) string {
+	var parts []string
+	for _, preamble := range []string{fluxPreamble, sensor.FluxPreamble} {
+		if preamble = strings.TrimSpace(preamble); preamble != "" {
+			parts = append(parts, preamble)
+		}
+	}
+	if len(parts) == 0 {
+		return query
+	}
+	return strings.Join(append(parts, query), "\n\n")
+}
+
+func buildSensorQueryBody(sensor Sensor, start, stop string) (string, map[string]interface{}) {
+	if sensor.Query != "" {
+		if stop == "" {
+			stop = "now()"
+		}
+		return strings.NewReplacer("{bucket}", influxBucket, "{measurement}", influxMeasurement, "{start}", start, "{stop}", stop).Replace(sensor.Query), nil
+	}
+
+	var params map[string]interface{}
+	if influxQueryParams {
+		params = make(map[string]interface{})
+	}
+	measurements, field := sensor.source()
+	return buildFluxQuery(fluxQuery{
+		Params:       params,
+		Bucket:       influxBucket,
+		Measurements: measurements,
+		Field:        field,
+		Tags:         sensor.Tags,
+		Aggregation:  sensor.Aggregation,
+		Quantile:     sensor.Quantile,
+		RangeStart:   start,
+		RangeStop:    stop,
+		Every:        sensor.AggregateEvery,
+		Fill:         sensor.Fill,
+		ValidMin:     sensor.toSourceUnit(sensor.ValidMin),
+		ValidMax:     sensor.toSourceUnit(sensor.ValidMax),
+
+		Smoothing:       sensor.Smoothing,
+		SmoothingPeriod: sensor.SmoothingPeriod,
+		SmoothingEvery:  sensor.SmoothingEvery,
+	}), params
+}
+
+// Map a sensor's logical field to the measurement and field it is stored as,
+// defaulting to a field of the same name in INFLUX_MEASUREMENT
+func resolveField(logical string) (string, string) {
+	measurement, field := influxMeasurement, logical
+	if mapping, ok := fieldMappings[logical]; ok {
+		if mapping.Measurement != "" {
+			measurement = mapping.Measurement
+		}
+		if mapping.Field != "" {
+			field = mapping.Field
+		}
+	}
+	return measurement, field
+}
+
+// Parameters of a generated Flux query
+type fluxQuery struct {
+	Bucket       string
+	Measurements []string // Points of several measurements are aggregated together
+	Field        string
+	Tags         map[string]string // Tag values the points have to match
+	Aggregation  string
+	Quantile     float64 // q of the quantile aggregation
+	RangeStart   string  // RFC3339 timestamp or a relative duration such as -1h
+	RangeStop    string  // Optional, the range ends now when empty
+	Every        string  // aggregateWindow period, empty aggregates the whole range
+	Fill         string  // "previous" or a float value to fill nulls with, see fillStage
+
+	// Points outside this range are dropped before anything else, either
+	// can be nil
+	ValidMin, ValidMax *float64
+
+	Smoothing       string // Moving average function applied before the aggregation, see smoothingStage
+	SmoothingPeriod string
+	SmoothingEvery  string
+
+	// When set, collects the string and time values and the query refers to
+	// them as params.name. Relative times stay in the query, Flux durations
+	// can't be passed as parameters.
+	Params map[string]interface{}
+}
+
+// A string literal, or a reference to the parameter holding it
+func (q fluxQuery) stringArg(name, value string) string {
+	if q.Params == nil {
+		return fmt.Sprintf(`"%s"`, value)
+	}
+	q.Params[name] = value
+	return "params." + name
+}
+
+// A range time as given, or a reference to the parameter holding it when
+// it is an RFC3339 timestamp
+func (q fluxQuery) timeArg(name, value string) string {
+	t, err := time.Parse(time.RFC3339, value)
+	if q.Params == nil || err != nil {
+		return value
+	}
+	q.Params[name] = t
+	return "params." + name
+}
+
+// Build the Flux query for an aggregation of a field
+func buildFluxQuery(q fluxQuery) string {
+	rangeArgs := fmt.Sprintf("start: %s", q.timeArg("start", q.RangeStart))
+	if q.RangeStop != "" {
+		rangeArgs += fmt.Sprintf(", stop: %s", q.timeArg("stop", q.RangeStop))
+	}
+
+	stages := []string{
+		fmt.Sprintf("from(bucket: %s)", q.stringArg("bucket", q.Bucket)),
+		fmt.Sprintf("range(%s)", rangeArgs),
+		measurementStage(q),
+		fmt.Sprintf("filter(fn: (r) => r._field == %s)", q.stringArg("field", q.Field)),
+	}
+	if len(q.Tags) > 0 {
+		stages = append(stages, tagStage(q))
+	}
+	if q.ValidMin != nil || q.ValidMax != nil {
+		stages = append(stages, validRangeStage(q))
+	}
+	if len(q.Measurements) > 1 {
+		// Merge the measurements into one table, in time order for the
+		// windows and first or last
+		stages = append(stages, "group()", `sort(columns: ["_time"])`)
+	}
+	if q.Smoothing != "" {
+		stages = append(stages, smoothingStage(q))
+	}
+
+	switch {
+	case q.Aggregation == "":
+		// The raw points, for --replay
+		if q.Fill != "" {
+			stages = append(stages, fillStage(q.Fill))
+		}
+	case q.Aggregation == "increase":
+		// increase() treats a drop as a counter reset, its last row is the
+		// total increase over the range
+		if q.Fill != "" {
+			stages = append(stages, fillStage(q.Fill))
+		}
+		stages = append(stages, "increase()", "last()")
+	case q.Every != "":
+		// Empty windows are only created when there's a fill for them
+		stages = append(stages, fmt.Sprintf("aggregateWindow(every: %s, fn: %s, createEmpty: %t)", q.Every, q.windowFunction(), q.Fill != ""))
+		if q.Fill != "" {
+			stages = append(stages, fillStage(q.Fill))
+		}
+	default:
+		if q.Fill != "" {
+			stages = append(stages, fillStage(q.Fill))
+		}
+		stages = append(stages, q.aggregationStage())
+	}
+
+	return strings.Join(stages, " \n\t\t|> ")
+}
+
+// The aggregation as a pipeline stage, e.g. max() or quantile(q: 0.95)
+func (q fluxQuery) aggregationStage() string {
+	if q.Aggregation == "quantile" {
+		return fmt.Sprintf("quantile(q: %s)", floatLiteral(q.Quantile))
+	}
+	return q.Aggregation + "()"
+}
+
+// The aggregation as aggregateWindow's fn. Functions with parameters of
+// their own need wrapping, aggregateWindow only passes the column.
+func (q fluxQuery) windowFunction() string {
+	if q.Aggregation == "quantile" {
+		return fmt.Sprintf("(column, tables=<-) => tables |> quantile(q: %s, column: column)", floatLiteral(q.Quantile))
+	}
+	return q.Aggregation
+}
+
+// Where the query path reads the current time from. Swapping it for a fixed
+// time makes the day boundaries reproducible, e.g. on a DST change.
+var clock = time.Now
+
+// The start of a sensor's query range, midnight for "today" or a relative
+// duration for a rolling window
+func rangeStart(sensor Sensor) string {
+	if sensor.Window != "" && sensor.Window != "today" {
+		return "-" + sensor.Window
+	}
+
+	// Get timestamp of midnight
+	midnightStr := midnight(clock()).Format(time.RFC3339)
+
+	log.Printf("Midnight timestamp: %s", midnightStr)
+	return midnightStr
+}
+
+// The start of the day t is in. Where DST starts at midnight there is no
+// 00:00, time.Date then falls back to the previous evening and the day really
+// starts when the new zone does.
+func midnight(t time.Time) time.Time {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if start.Day() != t.Day() {
+		start, _ = t.ZoneBounds()
+	}
+	return start
+}
+
+// Generalized InfluxDB query function, returning the float values in column
+// of every record in the order InfluxDB returns them: table by table, each
+// table's rows in time order
+func queryInfluxDBValue(ctx context.Context, name, query string, params map[string]interface{}, column string) ([]float64, error) {
+	tables, err := queryInfluxDBTables(ctx, name, query, params, column)
+	return slices.Concat(tables...), err
+}
+
+// Query a sensor and reduce the result to the records it publishes. With
+// tables set, each table's record is selected and the tables are combined
+// into one value.
+func (s Sensor) queryRecords(ctx context.Context, query string, params map[string]interface{}) ([]float64, error) {
+	tables, err := queryInfluxDBTables(ctx, s.Key, query, params, s.resultColumn())
+	if err != nil {
+		return nil, err
+	}
+	if s.Tables != "" {
+		return s.combineTables(tables), nil
+	}
+	return s.selectRecord(slices.Concat(tables...)), nil
+}
+
+// Run a query with retries, returning the float values in column of each
+// table of the result
+func queryInfluxDBTables(parent context.Context, name, query string, params map[string]interface{}, column string) ([][]float64, error) {
+	client := newInfluxClient()
+	defer client.Close()
+
+	queryAPI := client.QueryAPI(influxOrg)
+
+	// The client's retry options only cover writes, so failed queries are
+	// retried here
+	var err error
+	for i := 1; i <= maxRetries; i++ {
+		if i > 1 {
+			queryRetriesMetric.add(1, "query", name)
+			loopRetries.Add(1)
+		}
+		ctx, cancel := queryContext(parent)
+		var tables [][]float64
+		tables, err = readTables(ctx, queryAPI, query, params, column)
+		cancel()
+		if err != nil {
+			logThrottled("query "+err.Error(), "InfluxDB query failed (attempt %d/%d): %v", i, maxRetries, err)
+			if problem := permissionProblem(err); problem != "" {
+				return nil, &QueryError{name, ErrAuth, fmt.Sprintf("%s, the %s query failed", problem, name), err}
+			}
+			if !retryableQueryError(err) {
+				return nil, &QueryError{name, ErrQuery, fmt.Sprintf("InfluxDB rejected the %s query", name), err}
+			}
+			time.Sleep(queryRetryDelay(err))
+			continue
+		}
+
+		log.Printf("InfluxDB query successful: %s = %.2f", name, lastValue(slices.Concat(tables...)))
+		return tables, nil
+	}
+
+	kind := ErrQuery
+	if isTimeout(err) {
+		kind = ErrTimeout
+	}
+	return nil, &QueryError{name, kind, fmt.Sprintf("failed to retrieve %s from InfluxDB after %d attempts", name, maxRetries), err}
+}
+
+// What is wrong with the token when a query failed because of it, empty for
+// other errors. InfluxDB answers a bucket the token can't read as not found.
+func permissionProblem(err error) string {
+	var httpErr *ihttp.Error
+	if !errors.As(err, &httpErr) {
+		return ""
+	}
+	switch {
+	case httpErr.StatusCode == http.StatusUnauthorized:
+		return "the InfluxDB token is invalid or has expired"
+	case httpErr.StatusCode == http.StatusForbidden:
+		return fmt.Sprintf("the InfluxDB token lacks read permission on bucket %s", influxBucket)
+	case httpErr.StatusCode == http.StatusNotFound && strings.Contains(httpErr.Message, "bucket"):
+		return fmt.Sprintf("bucket %s doesn't exist in org %s, or the InfluxDB token lacks read permission on it", influxBucket, influxOrg)
+	}
+	return ""
+}
+
+// Check at startup that the token can read the bucket, exiting when it
+// can't. Other failures, such as InfluxDB being down, are only logged, the
+// loop keeps retrying those.
+func checkInfluxAccess() {
+	err := testInflux()
+	if permissionProblem(err) != "" {
+		log.Fatalf("Error: %v", err)
+	}
+	if err != nil {
+		log.Printf("Warning: couldn't check InfluxDB access: %v", err)
+	}
+}
+
+// Whether a failed query is worth repeating. InfluxDB rejecting the query
+// (invalid Flux, unknown bucket, missing permission) fails the same way every
+// time, apart from rate limiting.
+func retryableQueryError(err error) bool {
+	var httpErr *ihttp.Error
+	if errors.As(err, &httpErr) && httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 {
+		return httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// The wait before the next attempt, as long as the server asks for when it
+// is rate limiting
+func queryRetryDelay(err error) time.Duration {
+	var httpErr *ihttp.Error
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > 0 {
+		return time.Duration(httpErr.RetryAfter) * time.Second
+	}
+	return retryDelay
+}
+
+// A context for one query attempt, limited to INFLUX_QUERY_TIMEOUT when set
+func queryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if influxQueryTimeout > 0 {
+		return context.WithTimeout(parent, influxQueryTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// Run a query, with params when there are any, and read the float values in
+// column of every record, table by table. Tables are told apart by their
+// result and table columns, tables with the same columns share one
+// annotation block so TableChanged doesn't see them.
+func readTables(ctx context.Context, queryAPI api.QueryAPI, query string, params map[string]interface{}, column string) ([][]float64, error) {
+	result, err := runQuery(ctx, queryAPI, query, params)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	type tableID struct {
+		result string
+		table  int
+	}
+	var tables [][]float64
+	var current tableID
+	for result.Next() {
+		record := result.Record()
+		if id := (tableID{record.Result(), record.Table()}); tables == nil || id != current {
+			tables = append(tables, nil)
+			current = id
+		}
+		if v, ok := recordFloat(record.ValueByKey(column)); ok {
+			tables[len(tables)-1] = append(tables[len(tables)-1], v)
+		}
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("result error: %w", result.Err())
+	}
+	return tables, nil
+}
+
+// A numeric record value as a float. Integer fields, count() and increase()
+// of an integer field come back as long or unsignedLong.
+func recordFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// Run a query, passing params along with it when there are any
+func runQuery(ctx context.Context, queryAPI api.QueryAPI, query string, params map[string]interface{}) (*api.QueryTableResult, error) {
+	if params != nil {
+		return queryAPI.QueryWithParams(ctx, query, params)
+	}
+	return queryAPI.Query(ctx, query)
+}
+
+// The most recent value of a query result, zero when there were no records
+func lastValue(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	return values[len(values)-1]
+}
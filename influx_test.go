@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// A query from its stages, joined the way buildFluxQuery joins them
+func flux(stages ...string) string {
+	return strings.Join(stages, " \n\t\t|> ")
+}
+
+func ptr(v float64) *float64 { return &v }
+
+func TestBuildFluxQuery(t *testing.T) {
+	const (
+		from        = `from(bucket: "weather")`
+		measurement = `filter(fn: (r) => r._measurement == "sensor-data")`
+		field       = `filter(fn: (r) => r._field == "wind")`
+	)
+	tests := []struct {
+		name  string
+		query fluxQuery
+		want  string
+	}{
+		{
+			name:  "since midnight",
+			query: fluxQuery{Aggregation: "max", RangeStart: "2024-03-10T00:00:00+13:00"},
+			want:  flux(from, "range(start: 2024-03-10T00:00:00+13:00)", measurement, field, "max()"),
+		},
+		{
+			name:  "rolling window",
+			query: fluxQuery{Aggregation: "mean", RangeStart: "-10m"},
+			want:  flux(from, "range(start: -10m)", measurement, field, "mean()"),
+		},
+		{
+			name:  "fixed range",
+			query: fluxQuery{Aggregation: "min", RangeStart: "2024-01-01T00:00:00Z", RangeStop: "2024-02-01T00:00:00Z"},
+			want:  flux(from, "range(start: 2024-01-01T00:00:00Z, stop: 2024-02-01T00:00:00Z)", measurement, field, "min()"),
+		},
+		{
+			name:  "aggregate window",
+			query: fluxQuery{Aggregation: "mean", RangeStart: "-1h", Every: "10m"},
+			want:  flux(from, "range(start: -1h)", measurement, field, "aggregateWindow(every: 10m, fn: mean, createEmpty: false)"),
+		},
+		{
+			name:  "aggregate window with fill",
+			query: fluxQuery{Aggregation: "max", RangeStart: "-1h", Every: "10m", Fill: "previous"},
+			want:  flux(from, "range(start: -1h)", measurement, field, "aggregateWindow(every: 10m, fn: max, createEmpty: true)", "fill(usePrevious: true)"),
+		},
+		{
+			name:  "fill value",
+			query: fluxQuery{Aggregation: "sum", RangeStart: "-1h", Fill: "0"},
+			want:  flux(from, "range(start: -1h)", measurement, field, "fill(value: 0.0)", "sum()"),
+		},
+		{
+			name:  "tag filter",
+			query: fluxQuery{Aggregation: "max", RangeStart: "-1h", Tags: map[string]string{"station": "garden", "model": "ws-2902"}},
+			want:  flux(from, "range(start: -1h)", measurement, field, `filter(fn: (r) => r["model"] == "ws-2902" and r["station"] == "garden")`, "max()"),
+		},
+		{
+			name:  "valid range",
+			query: fluxQuery{Aggregation: "max", RangeStart: "-1h", ValidMin: ptr(-40), ValidMax: ptr(60.5)},
+			want:  flux(from, "range(start: -1h)", measurement, field, "filter(fn: (r) => r._value >= -40.0 and r._value <= 60.5)", "max()"),
+		},
+		{
+			name:  "several measurements",
+			query: fluxQuery{Measurements: []string{"sensor-data", "backup"}, Aggregation: "max", RangeStart: "-1h"},
+			want:  flux(from, "range(start: -1h)", `filter(fn: (r) => r._measurement == "sensor-data" or r._measurement == "backup")`, field, "group()", `sort(columns: ["_time"])`, "max()"),
+		},
+		{
+			name:  "raw points",
+			query: fluxQuery{RangeStart: "-1h"},
+			want:  flux(from, "range(start: -1h)", measurement, field),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			q.Bucket, q.Field = "weather", "wind"
+			if q.Measurements == nil {
+				q.Measurements = []string{"sensor-data"}
+			}
+			if got := buildFluxQuery(q); got != tt.want {
+				t.Errorf("buildFluxQuery() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildFluxQueryEachAggregation(t *testing.T) {
+	// The closing stages of every aggregation in validAggregations
+	tests := map[string][]string{
+		"sum":      {"sum()"},
+		"min":      {"min()"},
+		"max":      {"max()"},
+		"mean":     {"mean()"},
+		"median":   {"median()"},
+		"first":    {"first()"},
+		"last":     {"last()"},
+		"count":    {"count()"},
+		"spread":   {"spread()"},
+		"increase": {"increase()", "last()"},
+		"quantile": {"quantile(q: 0.9)"},
+	}
+	for aggregation := range validAggregations {
+		if _, ok := tests[aggregation]; !ok {
+			t.Errorf("no expected query for aggregation %q", aggregation)
+		}
+	}
+
+	base := []string{`from(bucket: "weather")`, "range(start: -1d)", `filter(fn: (r) => r._measurement == "sensor-data")`, `filter(fn: (r) => r._field == "wind")`}
+	for aggregation, stages := range tests {
+		t.Run(aggregation, func(t *testing.T) {
+			if !validAggregations[aggregation] {
+				t.Fatalf("%q isn't a valid aggregation", aggregation)
+			}
+			q := fluxQuery{Bucket: "weather", Measurements: []string{"sensor-data"}, Field: "wind", Aggregation: aggregation, Quantile: 0.9, RangeStart: "-1d"}
+			if got, want := buildFluxQuery(q), flux(append(base, stages...)...); got != want {
+				t.Errorf("buildFluxQuery() =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildSensorQueryTags(t *testing.T) {
+	sensor := Sensor{Key: "wind-max", Field: "wind", Aggregation: "max", Tags: map[string]string{"station": "garden"}}
+	query, _ := buildSensorQuery(sensor, "-1h", "")
+	if !strings.Contains(query, `filter(fn: (r) => r["station"] == "garden")`) {
+		t.Errorf("query has no tag filter:\n%s", query)
+	}
+
+	sensor.Tags = nil
+	query, _ = buildSensorQuery(sensor, "-1h", "")
+	if strings.Contains(query, "r[") {
+		t.Errorf("query without tags has a tag filter:\n%s", query)
+	}
+}
+
+func TestBuildFluxQueryIncrease(t *testing.T) {
+	q := fluxQuery{Bucket: "weather", Measurements: []string{"sensor-data"}, Field: "rain-counter", Aggregation: "increase", RangeStart: "2024-03-10T00:00:00Z"}
+	want := flux(`from(bucket: "weather")`, "range(start: 2024-03-10T00:00:00Z)", `filter(fn: (r) => r._measurement == "sensor-data")`,
+		`filter(fn: (r) => r._field == "rain-counter")`, "increase()", "last()")
+	if got := buildFluxQuery(q); got != want {
+		t.Errorf("buildFluxQuery() =\n%s\nwant\n%s", got, want)
+	}
+
+	// A fill comes before increase(), which would otherwise see the gaps
+	q.Fill = "previous"
+	want = flux(`from(bucket: "weather")`, "range(start: 2024-03-10T00:00:00Z)", `filter(fn: (r) => r._measurement == "sensor-data")`,
+		`filter(fn: (r) => r._field == "rain-counter")`, "fill(usePrevious: true)", "increase()", "last()")
+	if got := buildFluxQuery(q); got != want {
+		t.Errorf("buildFluxQuery() with fill =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildFluxQuerySmoothing(t *testing.T) {
+	base := []string{`from(bucket: "weather")`, "range(start: -1h)", `filter(fn: (r) => r._measurement == "sensor-data")`, `filter(fn: (r) => r._field == "wind")`}
+	tests := []struct {
+		name                  string
+		smoothing, period, ev string
+		stage                 string
+	}{
+		{"timed moving average", "timedMovingAverage", "10m", "", "timedMovingAverage(every: 1m, period: 10m)"},
+		{"timed moving average every", "timedMovingAverage", "10m", "2m", "timedMovingAverage(every: 2m, period: 10m)"},
+		{"moving average", "movingAverage", "5", "", "movingAverage(n: 5)"},
+		{"exponential moving average", "exponentialMovingAverage", "3", "", "exponentialMovingAverage(n: 3)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := fluxQuery{Bucket: "weather", Measurements: []string{"sensor-data"}, Field: "wind", Aggregation: "max", RangeStart: "-1h",
+				Smoothing: tt.smoothing, SmoothingPeriod: tt.period, SmoothingEvery: tt.ev}
+			// The points are smoothed before they are aggregated
+			want := flux(append(base, tt.stage, "max()")...)
+			if got := buildFluxQuery(q); got != want {
+				t.Errorf("buildFluxQuery() =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildFluxQueryParams(t *testing.T) {
+	params := map[string]interface{}{}
+	q := fluxQuery{Params: params, Bucket: "weather", Measurements: []string{"sensor-data", "backup"}, Field: "wind",
+		Tags: map[string]string{"station": "garden"}, Aggregation: "max",
+		RangeStart: "2024-01-01T00:00:00Z", RangeStop: "2024-02-01T00:00:00+13:00"}
+	want := flux("from(bucket: params.bucket)", "range(start: params.start, stop: params.stop)",
+		"filter(fn: (r) => r._measurement == params.measurement or r._measurement == params.measurement2)",
+		"filter(fn: (r) => r._field == params.field)", `filter(fn: (r) => r["station"] == params.tag)`,
+		"group()", `sort(columns: ["_time"])`, "max()")
+	if got := buildFluxQuery(q); got != want {
+		t.Errorf("buildFluxQuery() =\n%s\nwant\n%s", got, want)
+	}
+	wantParams := map[string]interface{}{
+		"bucket":       "weather",
+		"measurement":  "sensor-data",
+		"measurement2": "backup",
+		"field":        "wind",
+		"tag":          "garden",
+		"start":        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		"stop":         time.Date(2024, 2, 1, 0, 0, 0, 0, time.FixedZone("", 13*60*60)),
+	}
+	if len(params) != len(wantParams) {
+		t.Errorf("params = %v, want %v", params, wantParams)
+	}
+	for name, want := range wantParams {
+		got, ok := params[name]
+		// Times are compared as instants, the parsed zone has no name
+		if wantTime, isTime := want.(time.Time); isTime {
+			if gotTime, _ := got.(time.Time); !gotTime.Equal(wantTime) {
+				t.Errorf("params[%q] = %v, want %v", name, got, want)
+			}
+		} else if !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("params[%q] = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestBuildFluxQueryParamsRelativeRange(t *testing.T) {
+	// Flux durations can't be parameters, a relative start stays in the query
+	params := map[string]interface{}{}
+	q := fluxQuery{Params: params, Bucket: "weather", Measurements: []string{"sensor-data"}, Field: "wind", Aggregation: "mean", RangeStart: "-10m"}
+	want := flux("from(bucket: params.bucket)", "range(start: -10m)", "filter(fn: (r) => r._measurement == params.measurement)",
+		"filter(fn: (r) => r._field == params.field)", "mean()")
+	if got := buildFluxQuery(q); got != want {
+		t.Errorf("buildFluxQuery() =\n%s\nwant\n%s", got, want)
+	}
+	if _, ok := params["start"]; ok {
+		t.Errorf("relative start passed as a parameter: %v", params)
+	}
+}
+
+func TestBuildSensorQueryParams(t *testing.T) {
+	defer func(enabled bool) { influxQueryParams = enabled }(influxQueryParams)
+	sensor := Sensor{Key: "wind-max", Field: "wind", Aggregation: "max"}
+
+	influxQueryParams = false
+	if _, params := buildSensorQuery(sensor, "-1h", ""); params != nil {
+		t.Errorf("params without INFLUX_QUERY_PARAMS = %v, want nil", params)
+	}
+
+	influxQueryParams = true
+	query, params := buildSensorQuery(sensor, "-1h", "")
+	if params["field"] != "wind" || params["bucket"] != influxBucket {
+		t.Errorf("params = %v, want the bucket and the wind field", params)
+	}
+	if strings.Contains(query, `"wind"`) {
+		t.Errorf("query has the field inline:\n%s", query)
+	}
+
+	// Custom queries have their placeholders filled in and take no parameters
+	sensor.Query = `from(bucket: "{bucket}") |> range(start: {start}, stop: {stop})`
+	if _, params := buildSensorQuery(sensor, "-1h", ""); params != nil {
+		t.Errorf("custom query params = %v, want nil", params)
+	}
+}
+
+func TestBuildFluxQueryQuantile(t *testing.T) {
+	q := fluxQuery{Bucket: "weather", Measurements: []string{"sensor-data"}, Field: "wind", Aggregation: "quantile", Quantile: 0.95, RangeStart: "-1d"}
+	base := []string{`from(bucket: "weather")`, "range(start: -1d)", `filter(fn: (r) => r._measurement == "sensor-data")`, `filter(fn: (r) => r._field == "wind")`}
+	if got, want := buildFluxQuery(q), flux(append(base, "quantile(q: 0.95)")...); got != want {
+		t.Errorf("buildFluxQuery() =\n%s\nwant\n%s", got, want)
+	}
+
+	// aggregateWindow only passes the column, quantile needs wrapping for q
+	q.Every = "1h"
+	window := "aggregateWindow(every: 1h, fn: (column, tables=<-) => tables |> quantile(q: 0.95, column: column), createEmpty: false)"
+	if got, want := buildFluxQuery(q), flux(append(base, window)...); got != want {
+		t.Errorf("buildFluxQuery() with aggregate_every =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildSensorQueryQuantile(t *testing.T) {
+	sensor := Sensor{Key: "wind-p95", Field: "wind", Aggregation: "quantile", Quantile: 0.5}
+	query, _ := buildSensorQuery(sensor, "-1h", "")
+	if !strings.HasSuffix(query, "|> quantile(q: 0.5)") {
+		t.Errorf("query doesn't end with the sensor's quantile:\n%s", query)
+	}
+}
+
+func TestMidnightDST(t *testing.T) {
+	load := func(name string) *time.Location {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			t.Skipf("no time zone data for %s: %v", name, err)
+		}
+		return location
+	}
+	newYork, london, saoPaulo := load("America/New_York"), load("Europe/London"), load("America/Sao_Paulo")
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want string
+	}{
+		// Clocks go forward at 02:00, midnight is still in standard time
+		{"new york spring forward", time.Date(2024, 3, 10, 15, 0, 0, 0, newYork), "2024-03-10T00:00:00-05:00"},
+		{"new york before the change", time.Date(2024, 3, 10, 1, 59, 0, 0, newYork), "2024-03-10T00:00:00-05:00"},
+		{"london spring forward", time.Date(2024, 3, 31, 12, 0, 0, 0, london), "2024-03-31T00:00:00Z"},
+		{"london fall back", time.Date(2024, 10, 27, 23, 0, 0, 0, london), "2024-10-27T00:00:00+01:00"},
+		// DST started at midnight, the day begins at 01:00
+		{"sao paulo midnight gap", time.Date(2018, 11, 4, 9, 0, 0, 0, saoPaulo), "2018-11-04T01:00:00-02:00"},
+		{"sao paulo day after", time.Date(2018, 11, 5, 9, 0, 0, 0, saoPaulo), "2018-11-05T00:00:00-02:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := midnight(tt.now).Format(time.RFC3339); got != tt.want {
+				t.Errorf("midnight(%s) = %s, want %s", tt.now, got, tt.want)
+			}
+
+			defer func(now func() time.Time) { clock = now }(clock)
+			clock = func() time.Time { return tt.now }
+			if got := rangeStart(Sensor{Window: "today"}); got != tt.want {
+				t.Errorf("rangeStart() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Rain per station, one table each, as annotated CSV the way InfluxDB
+// returns it
+const rainTables = `#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string
+#group,false,false,true,true,false,false,true,true,true
+#default,_result,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,station
+,,0,2024-06-01T00:00:00Z,2024-06-02T00:00:00Z,2024-06-01T10:00:00Z,1.5,rain,sensor-data,garden
+,,0,2024-06-01T00:00:00Z,2024-06-02T00:00:00Z,2024-06-01T11:00:00Z,2.5,rain,sensor-data,garden
+,,1,2024-06-01T00:00:00Z,2024-06-02T00:00:00Z,2024-06-01T10:30:00Z,4,rain,sensor-data,roof
+
+`
+
+// Lightning strikes counted per station, an integer field
+const strikeTables = `#datatype,string,long,dateTime:RFC3339,long,string,string
+#group,false,false,true,false,true,true
+#default,_result,,,,,
+,result,table,_stop,_value,_field,station
+,,0,2024-06-02T00:00:00Z,3,strikes,garden
+,,1,2024-06-02T00:00:00Z,12,strikes,roof
+
+`
+
+// An InfluxDB answering every query with rainTables, handing each request's
+// body to check
+func fakeInflux(t *testing.T, check func(body map[string]interface{})) *httptest.Server {
+	t.Helper()
+	return fakeInfluxCSV(t, rainTables, check)
+}
+
+// An InfluxDB answering every query with csv
+func fakeInfluxCSV(t *testing.T, csv string, check func(body map[string]interface{})) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("query body: %v", err)
+		}
+		if check != nil {
+			check(body)
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Write([]byte(csv))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReadTables(t *testing.T) {
+	var queryParams interface{}
+	server := fakeInflux(t, func(body map[string]interface{}) { queryParams = body["params"] })
+	client := influxdb2.NewClient(server.URL, "token")
+	defer client.Close()
+	queryAPI := client.QueryAPI("org")
+
+	tables, err := readTables(context.Background(), queryAPI, "rain", nil, "_value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]float64{{1.5, 2.5}, {4}}; !reflect.DeepEqual(tables, want) {
+		t.Errorf("readTables() = %v, want %v", tables, want)
+	}
+	if queryParams != nil {
+		t.Errorf("query without params sent params %v", queryParams)
+	}
+
+	if _, err := readTables(context.Background(), queryAPI, "rain", map[string]interface{}{"field": "rain"}, "_value"); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"field": "rain"}; !reflect.DeepEqual(queryParams, want) {
+		t.Errorf("query params = %v, want %v", queryParams, want)
+	}
+}
+
+func TestReadTablesLong(t *testing.T) {
+	server := fakeInfluxCSV(t, strikeTables, nil)
+	client := influxdb2.NewClient(server.URL, "token")
+	defer client.Close()
+
+	tables, err := readTables(context.Background(), client.QueryAPI("org"), "strikes", nil, "_value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]float64{{3}, {12}}; !reflect.DeepEqual(tables, want) {
+		t.Errorf("readTables() = %v, want %v", tables, want)
+	}
+}
+
+func TestRecordFloat(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  float64
+		ok    bool
+	}{
+		{1.5, 1.5, true},
+		{int64(-3), -3, true},
+		{uint64(7), 7, true},
+		{"7", 0, false},
+		{nil, 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := recordFloat(tt.value); got != tt.want || ok != tt.ok {
+			t.Errorf("recordFloat(%#v) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestQueryRecordsTables(t *testing.T) {
+	server := fakeInflux(t, nil)
+	defer func(url string) { influxQueryURL = url }(influxQueryURL)
+	influxQueryURL = server.URL
+
+	tests := []struct {
+		sensor Sensor
+		want   []float64
+	}{
+		// Without tables the records of every table are one series
+		{Sensor{Key: "rain"}, []float64{1.5, 2.5, 4}},
+		{Sensor{Key: "rain", Record: "first"}, []float64{1.5}},
+		{Sensor{Key: "rain", Tables: "sum"}, []float64{6.5}},
+		{Sensor{Key: "rain", Tables: "max", Record: "first"}, []float64{4}},
+	}
+	for _, tt := range tests {
+		got, err := tt.sensor.queryRecords(context.Background(), "rain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("queryRecords() with tables %q record %q = %v, want %v", tt.sensor.Tables, tt.sensor.Record, got, tt.want)
+		}
+	}
+}
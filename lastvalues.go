@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"time"
+)
+
+// The last result with rows of a sensor and when it was queried
+type storedResult struct {
+	Values []float64 `json:"values"`
+	Time   time.Time `json:"time"`
+}
+
+// Sensors currently publishing their stored result
+var staleSensors = map[string]bool{}
+
+// Load the results LAST_VALUE_FILE was left with, so they can be published
+// when InfluxDB is down as the bridge starts
+func loadLastResults() {
+	if err := readStateFile(lastValueFile, &lastResults); err != nil {
+		log.Printf("Error loading %s, starting without stored values: %v", lastValueFile, err)
+	}
+}
+
+func saveLastResults() error {
+	return writeStateFile(lastValueFile, lastResults)
+}
+
+func rememberResult(sensor Sensor, values []float64) {
+	lastResults[sensor.Key] = storedResult{slices.Clone(values), clock()}
+}
+
+// With LAST_VALUE_FILE, the stored result a sensor publishes when its query
+// fails, instead of 0
+func storedResultFor(sensor Sensor) (storedResult, bool) {
+	if lastValueFile == "" {
+		return storedResult{}, false
+	}
+	stored, ok := lastResults[sensor.Key]
+	return stored, ok
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Print the effective configuration of every sensor, after the config file
+// and defaults have been applied
+func listSensors(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tFIELD\tAGGREGATION\tWINDOW\tSTATE TOPIC\tDEVICE CLASS\tUNIT\tUNIQUE ID")
+	for _, sensor := range sensors {
+		field, aggregation := "(custom query)", "-"
+		if sensor.Compute != "" {
+			field = "(" + sensor.Compute + ")"
+		} else if sensor.Query == "" {
+			measurements, name := sensor.source()
+			field = strings.Join(measurements, "+") + "/" + name
+			aggregation = sensor.Aggregation
+			if sensor.AggregateEvery != "" {
+				aggregation += " every " + sensor.AggregateEvery
+			}
+			if sensor.Accumulate {
+				aggregation = "accumulate"
+			}
+			if sensor.Delta {
+				aggregation += " delta"
+			}
+		}
+
+		window := sensor.Window
+		if window == "" {
+			window = "today"
+		}
+		if queryStart != "" {
+			window = queryStart + ".." + queryStop
+		}
+		if queryWindow == "since-start" {
+			window = "since " + bridgeStart.Format(time.RFC3339)
+		}
+
+		topic := sensor.stateTopic()
+		if combinedJSON && !sensor.hasExternalTopic() {
+			topic = fmt.Sprintf(mqttCombinedStateTopic, mqttSensor) + " [" + strings.TrimPrefix(sensor.jsonValuePath(), "value_json") + "]"
+		}
+
+		uniqueID := sensor.uniqueID()
+		if sensor.hasExternalTopic() {
+			uniqueID = "(no discovery)"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", sensor.Key, field, aggregation, window, topic,
+			orDash(sensor.DeviceClass), orDash(sensor.Unit), uniqueID)
+	}
+	tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
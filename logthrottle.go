@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type throttledLine struct {
+	last       time.Time
+	suppressed int
+}
+
+const maxThrottledLines = 1000
+
+var (
+	throttleMu    sync.Mutex
+	throttleLines = make(map[string]*throttledLine)
+)
+
+// Log an error line at most once per LOG_REPEAT_INTERVAL for each key, so an
+// outage doesn't flood the log with the same error from every retry. Lines
+// in between are counted and the count is added to the next line logged.
+// The key is the part of the message that identifies the error, without
+// attempt counters.
+func logThrottled(key, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if logRepeatInterval <= 0 {
+		log.Output(2, message)
+		return
+	}
+
+	throttleMu.Lock()
+	now := time.Now()
+	if len(throttleLines) > maxThrottledLines {
+		// Forget errors that haven't been seen for a while, errors with
+		// changing details would otherwise fill the map
+		for k, l := range throttleLines {
+			if now.Sub(l.last) >= logRepeatInterval {
+				delete(throttleLines, k)
+			}
+		}
+	}
+	line, seen := throttleLines[key]
+	if !seen {
+		line = &throttledLine{}
+		throttleLines[key] = line
+	}
+	if seen && now.Sub(line.last) < logRepeatInterval {
+		line.suppressed++
+		throttleMu.Unlock()
+		return
+	}
+	suppressed := line.suppressed
+	line.last = now
+	line.suppressed = 0
+	throttleMu.Unlock()
+
+	if suppressed > 0 {
+		message += fmt.Sprintf(" (repeated %d times since the last report)", suppressed)
+	}
+	log.Output(2, message)
+}
@@ -3,31 +3,96 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
-
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 )
 
 // Load environment variables with default values
 var (
 	influxURL             = getEnv("INFLUX_URL", "http://localhost:8086")
 	influxToken           = getEnv("INFLUX_TOKEN", "")
+	influxQueryURL        = getEnv("INFLUX_QUERY_URL", influxURL)
+	influxQueryToken      = getEnv("INFLUX_QUERY_TOKEN", influxToken)
 	influxOrg             = getEnv("INFLUX_ORG", "your-org")
 	influxBucket          = getEnv("INFLUX_BUCKET", "your-bucket")
+	influxMeasurement     = getEnv("INFLUX_MEASUREMENT", "sensor-data")
+	influxHTTPTimeout     = getEnvDuration("INFLUX_HTTP_TIMEOUT", 20*time.Second)
+	influxQueryTimeout    = getEnvDuration("INFLUX_QUERY_TIMEOUT", 0)
+	influxQueryParams     = getEnv("INFLUX_QUERY_PARAMS", "false") == "true"
+	influxGzip            = getEnv("INFLUX_GZIP", "true") == "true"
+	queryStart            = getEnvTimestamp("QUERY_START")
+	queryStop             = getEnvTimestamp("QUERY_STOP")
+	windowStop            = getEnv("WINDOW_STOP", "now")
+	queryWindow           = getEnv("QUERY_WINDOW", "")
+	bridgeStart           = time.Now() // Range start of QUERY_WINDOW=since-start
+	roundingMode          = getEnv("ROUNDING_MODE", "nearest")
 	mqttBroker            = getEnv("MQTT_BROKER", "tcp://homeassistant.local:1883")
 	mqttUsername          = getEnv("MQTT_USERNAME", "")
 	mqttPassword          = getEnv("MQTT_PASSWORD", "")
 	mqttSensor            = getEnv("MQTT_SENSOR", "influx-import")
-	publishInterval       = 2 * time.Minute // Send rain & wind data every 2 minutes
-	configPublishInterval = 12 * time.Hour  // Republish MQTT discovery config every 12 hours
+	deviceArea            = getEnv("DEVICE_AREA", "Garage")
+	stateTopicTemplate    = getEnv("STATE_TOPIC_TEMPLATE", "")
+	mqttCleanSession      = getEnv("MQTT_CLEAN_SESSION", "true") == "true"
+	mqttOrderMatters      = getEnv("MQTT_ORDER_MATTERS", "true") == "true"
+	mqttTargets           = loadMqttTargets()
+	maintenanceWindow     = getEnv("MAINTENANCE_WINDOW", "")
+	configFile            = getEnv("CONFIG_FILE", "")
+	profile               = getEnv("PROFILE", "")
+	accumulatorFile       = getEnv("ACCUMULATOR_FILE", "accumulators.json")
+	deadLetterFile        = getEnv("DEAD_LETTER_FILE", "")
+	lastValueFile         = getEnv("LAST_VALUE_FILE", "")
+	combinedJSON          = getEnv("COMBINED_JSON", "false") == "true"
+	errorSensor           = getEnv("ERROR_SENSOR", "false") == "true"
+	timeDriftSensor       = getEnv("TIME_DRIFT_SENSOR", "false") == "true"
+	retrySensor           = getEnv("RETRY_SENSOR", "false") == "true"
+	maxClockSkew          = getEnvDuration("MAX_CLOCK_SKEW", 5*time.Second)
+	discoveryRetain       = getEnv("DISCOVERY_RETAIN", "true") == "true"
+	configQoS             = getEnvQoS("CONFIG_QOS", 0)
+	stateQoS              = getEnvQoS("STATE_QOS", 0)
+	availabilityQoS       = getEnvQoS("AVAILABILITY_QOS", 0)
+	republishConfigs      = getEnv("REPUBLISH_CONFIG", "true") == "true"
+	discoverySettleDelay  = getEnvDuration("DISCOVERY_SETTLE_DELAY", 0)
+	eventTopic            = getEnv("EVENT_TOPIC", "")
+	haURL                 = getEnv("HA_URL", "")
+	haToken               = getEnv("HA_TOKEN", "")
+	mqttWatchdogThreshold = getEnvInt("MQTT_WATCHDOG_THRESHOLD", 3)
+	publishTimeout        = getEnvDuration("MQTT_PUBLISH_TIMEOUT", 10*time.Second)
+	publishInterval       = getEnvDuration("PUBLISH_INTERVAL", 2*time.Minute) // Send rain & wind data every 2 minutes
+	queryConcurrency      = getEnvInt("QUERY_CONCURRENCY", 1)
+	startupRetries        = getEnvInt("STARTUP_RETRIES", 10)
+	startupRetryInterval  = getEnvDuration("STARTUP_RETRY_INTERVAL", 15*time.Second)
+	maxLoopDuration       = getEnvDuration("MAX_LOOP_DURATION", publishInterval)
+	publishJitter         = getEnvJitter("PUBLISH_JITTER")
+	metricsAddr           = getEnv("METRICS_ADDR", "")
+	logRepeatInterval     = getEnvDuration("LOG_REPEAT_INTERVAL", 5*time.Minute)
+	availabilityMode      = getEnv("AVAILABILITY_MODE", "state")
+	availabilityInterval  = getEnvDuration("AVAILABILITY_INTERVAL", 0)
+	availabilityJSON      = getEnv("AVAILABILITY_JSON", "false") == "true"
+	availabilityTemplate  = getEnv("AVAILABILITY_TEMPLATE", "{{ value_json.state }}")
+	expireAfter           = getEnvDuration("EXPIRE_AFTER", defaultExpireAfter())
+	configPublishInterval = 12 * time.Hour // Republish MQTT discovery config every 12 hours
 
 )
 
+// In lwt_only mode states expire after three missed loops unless set
+func defaultExpireAfter() time.Duration {
+	if availabilityMode == "lwt_only" {
+		return 3 * publishInterval
+	}
+	return 0
+}
+
 // Utility function to get environment variables with a fallback default value
 func getEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
@@ -36,31 +101,79 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-// MQTT Configuration
-const (
-	mqttRainTopic  = "homeassistant/sensor/%s/rain/state"
-	mqttRainConfig = "homeassistant/sensor/%s/rain/config"
+// Get an integer environment variable, exiting if it isn't a number
+func getEnvInt(key string, defaultValue int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	return n
+}
 
-	mqttWindTopic  = "homeassistant/sensor/%s/wind-max/state"
-	mqttWindConfig = "homeassistant/sensor/%s/wind-max/config"
+// Get an MQTT QoS level environment variable, exiting unless it's 0, 1 or 2
+func getEnvQoS(key string, defaultValue byte) byte {
+	qos := getEnvInt(key, int(defaultValue))
+	if qos < 0 || qos > 2 {
+		log.Fatalf("Invalid %s %d, use 0, 1 or 2", key, qos)
+	}
+	return byte(qos)
+}
 
-	mqttWindGustTopic  = "homeassistant/sensor/%s/wind-gust-max/state"
-	mqttWindGustConfig = "homeassistant/sensor/%s/wind-gust-max/config"
+// Get a duration environment variable such as 90s or 2m, exiting if it can't
+// be parsed
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	return d
+}
 
-	mqttMinTempTopic  = "homeassistant/sensor/%s/temperature-min/state"
-	mqttMinTempConfig = "homeassistant/sensor/%s/temperature-min/config"
-	mqttMaxTempTopic  = "homeassistant/sensor/%s/temperature-max/state"
-	mqttMaxTempConfig = "homeassistant/sensor/%s/temperature-max/config"
+// Get a jitter duration environment variable, written as 15s or ±15s
+func getEnvJitter(key string) time.Duration {
+	value := strings.TrimPrefix(getEnv(key, ""), "±")
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Fatalf("Invalid %s %q, use a duration such as 15s", key, value)
+	}
+	return d
+}
 
-	mqttMinHumidTopic  = "homeassistant/sensor/%s/humidity-min/state"
-	mqttMinHumidConfig = "homeassistant/sensor/%s/humidity-min/config"
-	mqttMaxHumidTopic  = "homeassistant/sensor/%s/humidity-max/state"
-	mqttMaxHumidConfig = "homeassistant/sensor/%s/humidity-max/config"
+// Get an RFC3339 timestamp environment variable, exiting if it can't be
+// parsed. Empty when unset.
+func getEnvTimestamp(key string) string {
+	value := getEnv(key, "")
+	if value == "" {
+		return ""
+	}
+	if _, err := time.Parse(time.RFC3339, value); err != nil {
+		log.Fatalf("Invalid %s %q, expected an RFC3339 timestamp such as 2024-01-01T00:00:00Z: %v", key, value, err)
+	}
+	return value
+}
+
+func parseTime(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339, value)
+	return t
+}
 
-	mqttMinPressureTopic  = "homeassistant/sensor/%s/pressure-min/state"
-	mqttMinPressureConfig = "homeassistant/sensor/%s/pressure-min/config"
-	mqttMaxPressureTopic  = "homeassistant/sensor/%s/pressure-max/state"
-	mqttMaxPressureConfig = "homeassistant/sensor/%s/pressure-max/config"
+// MQTT Configuration
+const (
+	mqttStateTopic  = "homeassistant/%s/%s/%s/state" // Component, MQTT_SENSOR, sensor key
+	mqttConfigTopic = "homeassistant/%s/%s/%s/config"
+
+	mqttCombinedStateTopic = "homeassistant/sensor/%s/state"
 
 	mqttAvail = "homeassistant/sensor/%s/availability"
 )
@@ -73,23 +186,52 @@ const (
 
 // Home Assistant MQTT Discovery Config
 type MqttConfig struct {
-	DeviceClass         string `json:"device_class"`
-	Name                string `json:"name"`
-	StateTopic          string `json:"state_topic"`
-	StateClass          string `json:"state_class"`
-	UnitOfMeasurement   string `json:"unit_of_measurement"`
-	ValueTemplate       string `json:"value_template"`
-	UniqueID            string `json:"unique_id"`
-	AvailabilityTopic   string `json:"availability_topic"`
-	PayloadAvailable    string `json:"payload_available"`
-	PayloadNotAvailable string `json:"payload_not_available"`
-	Device              Device `json:"device"`
+	DeviceClass          string                    `json:"device_class"`
+	Name                 string                    `json:"name"`
+	StateTopic           string                    `json:"state_topic"`
+	StateClass           string                    `json:"state_class,omitempty"`
+	UnitOfMeasurement    string                    `json:"unit_of_measurement,omitempty"`
+	ValueTemplate        string                    `json:"value_template,omitempty"`
+	PayloadOn            string                    `json:"payload_on,omitempty"`
+	PayloadOff           string                    `json:"payload_off,omitempty"`
+	UniqueID             string                    `json:"unique_id"`
+	ObjectID             string                    `json:"object_id,omitempty"`
+	AvailabilityTopic    string                    `json:"availability_topic,omitempty"`
+	PayloadAvailable     string                    `json:"payload_available,omitempty"`
+	PayloadNotAvailable  string                    `json:"payload_not_available,omitempty"`
+	AvailabilityTemplate string                    `json:"availability_template,omitempty"`
+	Availability         []availabilityTopicConfig `json:"availability,omitempty"`
+	AvailabilityMode     string                    `json:"availability_mode,omitempty"`
+	ExpireAfter          int                       `json:"expire_after,omitempty"`
+	ForceUpdate          bool                      `json:"force_update,omitempty"`
+	EnabledByDefault     *bool                     `json:"enabled_by_default,omitempty"`
+	CommandTopic         string                    `json:"command_topic,omitempty"`
+	Min                  *float64                  `json:"min,omitempty"`
+	Max                  *float64                  `json:"max,omitempty"`
+	Step                 float64                   `json:"step,omitempty"`
+	Mode                 string                    `json:"mode,omitempty"`
+	Retain               bool                      `json:"retain,omitempty"`
+	EntityCategory       string                    `json:"entity_category,omitempty"`
+	Icon                 string                    `json:"icon,omitempty"`
+	JSONAttributesTopic  string                    `json:"json_attributes_topic,omitempty"`
+	Device               Device                    `json:"device"`
+	Origin               *Origin                   `json:"origin,omitempty"`
+}
+
+// The software that created the entity, shown in Home Assistant's MQTT info
+type Origin struct {
+	Name       string `json:"name"`
+	SwVersion  string `json:"sw_version"`
+	SupportURL string `json:"support_url"`
 }
 
+const supportURL = "https://github.com/mwinters-stuff/go-influx-homeassistant"
+
 type Device struct {
-	Name          string `json:"name"`
-	SuggestedArea string `json:"suggested_area"`
-	Identifiers   string `json:"identifiers"` // Add Identifiers field
+	Name          string      `json:"name"`
+	SuggestedArea string      `json:"suggested_area"`
+	Identifiers   []string    `json:"identifiers"`
+	Connections   [][2]string `json:"connections,omitempty"` // Type and id pairs, e.g. mac and a MAC address
 }
 
 // Set up logging to file and console
@@ -102,270 +244,509 @@ func setupLogging() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
-// Query InfluxDB for rain data since midnight
-func queryInfluxDB(field, aggFunction string) (float64, error) {
-	log.Printf("Querying InfluxDB for %s of %s data...\n", aggFunction, field)
-	return queryInfluxDBValue("sensor-data", field, aggFunction)
-}
-
-// Generalized InfluxDB query function
-func queryInfluxDBValue(measurement, field, aggFunction string) (float64, error) {
-	client := influxdb2.NewClient(influxURL, influxToken)
-	defer client.Close()
+func generateMqttConfig(device Device, sensor Sensor) MqttConfig {
+	stateTopic := sensor.stateTopic()
+	value := "value"
+	if combinedJSON {
+		stateTopic = fmt.Sprintf(mqttCombinedStateTopic, mqttSensor)
+		value = sensor.jsonValuePath()
+	} else if sensor.publishesArray() {
+		value = "value_json"
+	}
+	if sensor.publishesArray() {
+		value += " | last"
+	}
 
-	queryAPI := client.QueryAPI(influxOrg)
+	config := MqttConfig{
+		DeviceClass:       sensor.DeviceClass,
+		Name:              sensor.Name,
+		StateTopic:        stateTopic,
+		StateClass:        sensor.StateClass,
+		UnitOfMeasurement: sensor.Unit,
+		ValueTemplate:     fmt.Sprintf("{{ %s | float }}", value),
+		UniqueID:          sensor.uniqueID(),
+		ObjectID:          objectID(sensor.Key),
+		ExpireAfter:       int(expireAfter.Seconds()),
+		ForceUpdate:       sensor.ForceUpdate,
+		EnabledByDefault:  sensor.EnabledByDefault,
+		Icon:              sensor.icon(),
+		Device:            device,
+	}
+	setAvailability(&config)
+	if sensor.noDataBehavior() == "unavailable" {
+		addSensorAvailability(&config, sensor)
+	}
 
-	// Get timestamp of midnight
-	now := time.Now()
-	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-	midnightStr := midnight.Format(time.RFC3339)
+	if sensor.publishesText() {
+		// Binary sensors are published as their on/off payloads, formatted
+		// sensors as text such as NNE
+		config.StateClass = ""
+		config.UnitOfMeasurement = ""
+		config.ValueTemplate = ""
+		if combinedJSON {
+			config.ValueTemplate = fmt.Sprintf("{{ %s }}", value)
+		}
+	}
+	if sensor.isBinary() {
+		config.PayloadOn = sensor.payloadOn()
+		config.PayloadOff = sensor.payloadOff()
+	}
+	if sensor.hasAttributes() {
+		config.JSONAttributesTopic = sensor.attributesTopic()
+	}
+	return config
+}
 
-	log.Printf("Midnight timestamp: %s", midnightStr)
+// A discovery config and the component and topic it is published under
+type discoveryEntry struct {
+	Component string
+	Topic     string
+	Config    MqttConfig
+}
 
-	query := fmt.Sprintf(`from(bucket: "%s") 
-		|> range(start: %s) 
-		|> filter(fn: (r) => r._measurement == "%s") 
-		|> filter(fn: (r) => r._field == "%s") 
-		|> %s()`, influxBucket, midnightStr, measurement, field, aggFunction)
+// Build every discovery config the bridge publishes
+func discoveryConfigs() []discoveryEntry {
+	var device = Device{
+		Name:          "Influx Import",
+		SuggestedArea: deviceArea,
+		Identifiers:   append([]string{mqttSensor}, deviceIdentifiers...),
+		Connections:   deviceConnections,
+	}
 
-	var value float64
-	for i := 1; i <= maxRetries; i++ {
-		result, err := queryAPI.Query(context.Background(), query)
-		if err != nil {
-			log.Printf("InfluxDB query failed (attempt %d/%d): %v", i, maxRetries, err)
-			time.Sleep(retryDelay)
+	var entries []discoveryEntry
+	for _, sensor := range sensors {
+		if sensor.hasExternalTopic() {
 			continue
 		}
-
-		for result.Next() {
-			if v, ok := result.Record().Value().(float64); ok {
-				value = v
-			}
+		entries = append(entries, discoveryEntry{sensor.component(), sensor.configTopic(), generateMqttConfig(device, sensor)})
+	}
+	for _, sensor := range sensors {
+		if sensor.AlertNumber != nil {
+			entries = append(entries, discoveryEntry{"number", sensor.alertNumberTopic("config"), alertNumberConfig(device, sensor)})
 		}
+	}
+	if errorSensor {
+		entries = append(entries, discoveryEntry{"sensor", fmt.Sprintf(mqttConfigTopic, "sensor", mqttSensor, errorSensorKey), errorSensorConfig(device)})
+	}
+	if timeDriftSensor {
+		entries = append(entries, discoveryEntry{"sensor", fmt.Sprintf(mqttConfigTopic, "sensor", mqttSensor, timeDriftSensorKey), timeDriftSensorConfig(device)})
+	}
+	if retrySensor {
+		entries = append(entries, discoveryEntry{"sensor", fmt.Sprintf(mqttConfigTopic, "sensor", mqttSensor, retrySensorKey), retrySensorConfig(device)})
+	}
+	return entries
+}
 
-		if result.Err() != nil {
-			log.Printf("InfluxDB result error: %v", result.Err())
-			time.Sleep(retryDelay)
+// Publish MQTT Discovery Config for Home Assistant
+func publishMqttConfig(conns []*mqttConnection) {
+	log.Println("Publishing MQTT discovery config...")
+
+	entries := snapshotDiscoveryConfigs()
+
+	// Each broker gets the configs in order, without waiting for the others.
+	// A broker that is still connecting gets them once it connects, instead
+	// of holding up the states while every publish to it is retried.
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		if !c.readyForDiscovery() {
+			log.Printf("MQTT broker %s isn't connected, sending its discovery configs when it connects", c.target.Broker)
 			continue
 		}
-
-		log.Printf("InfluxDB query successful: %s = %.2f", measurement, value)
-		return value, nil
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			publishDiscoveryConfigs(c, entries)
+		}()
 	}
+	wg.Wait()
+}
 
-	return 0, fmt.Errorf("failed to retrieve %s from InfluxDB after %d attempts", measurement, maxRetries)
+// Only the configs are built under the lock, so a broker that is down
+// doesn't hold up a reload while its publishes are retried
+func snapshotDiscoveryConfigs() []discoveryEntry {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return discoveryConfigs()
 }
 
-func extractSensorType(topic string) string {
-	parts := strings.Split(topic, "/")
-	if len(parts) > 3 {
-		return parts[3]
+func publishDiscoveryConfigs(c *mqttConnection, entries []discoveryEntry) {
+	for _, entry := range entries {
+		publishDiscovery(c, entry.Topic, entry.Config)
 	}
-	return ""
 }
 
-func generateMqttConfig(device Device, stateTopic, deviceClass, name, unit, stateClass string) MqttConfig {
-	return MqttConfig{
-		DeviceClass:         deviceClass,
-		Name:                name,
-		StateTopic:          fmt.Sprintf(stateTopic, mqttSensor),
-		StateClass:          stateClass,
-		UnitOfMeasurement:   unit,
-		ValueTemplate:       "{{ value | float }}",
-		UniqueID:            fmt.Sprintf("%s-sensor-%s", mqttSensor, extractSensorType(stateTopic)),
-		AvailabilityTopic:   fmt.Sprintf(mqttAvail, mqttSensor),
-		PayloadAvailable:    "online",
-		PayloadNotAvailable: "offline",
-		Device:              device,
+// Give Home Assistant DISCOVERY_SETTLE_DELAY to create the entities before
+// the first states. Each config publish has already been waited for, so the
+// brokers have the configs first either way.
+func settleDiscovery() {
+	if discoverySettleDelay > 0 {
+		log.Printf("Waiting %s for Home Assistant to register the entities", discoverySettleDelay)
+		time.Sleep(discoverySettleDelay)
 	}
 }
 
-// Publish MQTT Discovery Config for Home Assistant
-func publishMqttConfig(client mqtt.Client) {
-	log.Println("Publishing MQTT discovery config...")
-
-	var device = Device{Name: "Influx Import", SuggestedArea: "Garage", Identifiers: mqttSensor}
-
-	configs := []struct {
-		Topic  string
-		Config MqttConfig
-	}{
-		{
-			fmt.Sprintf(mqttRainConfig, mqttSensor),
-			generateMqttConfig(device, mqttRainTopic, "precipitation", "Rainfall Sensor", "mm", "total_increasing"),
-		},
-		{
-			fmt.Sprintf(mqttWindConfig, mqttSensor),
-			generateMqttConfig(device, mqttWindTopic, "wind_speed", "Max Wind Speed", "km/h", "measurement"),
-		},
-		{
-			fmt.Sprintf(mqttWindGustConfig, mqttSensor),
-			generateMqttConfig(device, mqttWindGustTopic, "wind_speed", "Max Wind Gust Speed", "km/h", "measurement"),
-		},
-		{
-			fmt.Sprintf(mqttMinTempConfig, mqttSensor),
-			generateMqttConfig(device, mqttMinTempTopic, "temperature", "Minimum Temperature", "℃", "measurement"),
-		},
-		{
-			fmt.Sprintf(mqttMaxTempConfig, mqttSensor),
-			generateMqttConfig(device, mqttMaxTempTopic, "temperature", "Maximum Temperature", "℃", "measurement"),
-		},
-		{
-			fmt.Sprintf(mqttMinHumidConfig, mqttSensor),
-			generateMqttConfig(device, mqttMinHumidTopic, "humidity", "Minimum Humidity", "%", "measurement"),
-		},
-		{
-			fmt.Sprintf(mqttMaxHumidConfig, mqttSensor),
-			generateMqttConfig(device, mqttMaxHumidTopic, "humidity", "Maximum Humidity", "%", "measurement"),
-		},
-		{
-			fmt.Sprintf(mqttMinPressureConfig, mqttSensor),
-			generateMqttConfig(device, mqttMinPressureTopic, "pressure", "Minimum Pressure", "hPa", "measurement"),
-		},
-		{
-			fmt.Sprintf(mqttMaxPressureConfig, mqttSensor),
-			generateMqttConfig(device, mqttMaxPressureTopic, "pressure", "Maximum Pressure", "hPa", "measurement"),
-		},
-	}
-
-	for _, c := range configs {
-		configPayload, err := json.Marshal(c.Config)
-		if err != nil {
-			log.Printf("Error marshalling config for %s: %v", c.Config.Name, err)
-			continue
-		}
+// Publish a discovery config with the bridge as its origin. The origin is
+// left out of export-ha-yaml, Home Assistant's YAML config has no such key.
+func publishDiscovery(c *mqttConnection, topic string, config MqttConfig) {
+	config.Origin = &Origin{Name: "influx-mqtt-homeassistant", SwVersion: version, SupportURL: supportURL}
+	configPayload, err := json.Marshal(config)
+	if err != nil {
+		log.Printf("Error marshalling config for %s: %v", config.Name, err)
+		return
+	}
 
-		client.Publish(c.Topic, 0, true, configPayload).Wait()
-		log.Printf("Home Assistant MQTT discovery config sent for %s", c.Config.Name)
+	if err := c.publishWithRetry(topic, configQoS, discoveryRetain, configPayload); err != nil {
+		log.Printf("Error publishing discovery config for %s to %s: %v", config.Name, c.target.Broker, err)
+		return
 	}
+	log.Printf("Home Assistant MQTT discovery config sent for %s to %s", config.Name, c.target.Broker)
 }
 
-// Publish data to MQTT
-func publishToMQTT(client mqtt.Client, topic string, value float64) {
-	client.Publish(fmt.Sprintf(mqttAvail, mqttSensor), 0, true, "online").Wait()
+func main() {
+	setupLogging()
 
-	payload := fmt.Sprintf("%.2f", value)
-	postTopic := fmt.Sprintf(topic, mqttSensor)
-	client.Publish(postTopic, 0, false, payload).Wait()
-	log.Printf("Published to %s: %.2f", postTopic, value)
-}
+	if err := validateMqttTargets(mqttTargets); err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig, err := loadMqttTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mqttTLSConfig = tlsConfig
+	if mqttSocksProxy, err = parseSocksProxy(getEnv("MQTT_SOCKS_PROXY", "")); err != nil {
+		log.Fatalf("Invalid MQTT_SOCKS_PROXY: %v", err)
+	}
+	if queryWindow != "" && queryWindow != "since-start" {
+		log.Fatalf("Invalid QUERY_WINDOW %q, use since-start", queryWindow)
+	}
+	if queryWindow != "" && queryStart != "" {
+		log.Fatal("QUERY_WINDOW can't be used with QUERY_START")
+	}
+	if queryStop != "" && queryStart == "" {
+		log.Fatal("QUERY_STOP needs QUERY_START")
+	}
+	if start, stop := parseTime(queryStart), parseTime(queryStop); queryStop != "" && !start.Before(stop) {
+		log.Fatalf("QUERY_START %s must be before QUERY_STOP %s", queryStart, queryStop)
+	}
+	if err := validateTopicTemplate(stateTopicTemplate); err != nil {
+		log.Fatalf("Invalid STATE_TOPIC_TEMPLATE: %v", err)
+	}
+	if !roundingModes[roundingMode] {
+		log.Fatalf("Invalid ROUNDING_MODE %q, use nearest, floor, ceil or truncate", roundingMode)
+	}
+	if windowStop != "now" && windowStop != "latest-data" {
+		log.Fatalf("Invalid WINDOW_STOP %q, use now or latest-data", windowStop)
+	}
+	if publishTimeout <= 0 {
+		log.Fatalf("MQTT_PUBLISH_TIMEOUT has to be positive, a publish must not wait forever")
+	}
+	if maintenanceWindow != "" {
+		window, err := parseDailyWindow(maintenanceWindow)
+		if err != nil {
+			log.Fatalf("Invalid MAINTENANCE_WINDOW %q: %v", maintenanceWindow, err)
+		}
+		maintenance = window
+	}
+	if publishJitter >= publishInterval {
+		log.Fatalf("PUBLISH_JITTER %s must be shorter than PUBLISH_INTERVAL %s", publishJitter, publishInterval)
+	}
+	if queryConcurrency < 1 {
+		log.Fatalf("QUERY_CONCURRENCY has to be at least 1")
+	}
+	if startupRetries < 0 || startupRetries > 0 && startupRetryInterval <= 0 {
+		log.Fatalf("STARTUP_RETRIES can't be negative and STARTUP_RETRY_INTERVAL has to be positive")
+	}
+	if availabilityMode != "state" && availabilityMode != "lwt_only" {
+		log.Fatalf("Invalid AVAILABILITY_MODE %q, use state or lwt_only", availabilityMode)
+	}
+	if haURL != "" && haToken == "" {
+		log.Fatal("HA_URL needs HA_TOKEN, a long-lived access token")
+	}
+	if availabilityInterval < 0 || availabilityInterval > 0 && availabilityMode == "lwt_only" {
+		log.Fatalf("AVAILABILITY_INTERVAL can't be negative or used with AVAILABILITY_MODE=lwt_only")
+	}
 
-// Connect to MQTT with retry mechanism
-func connectToMQTT() mqtt.Client {
-	opts := mqtt.NewClientOptions().
-		AddBroker(mqttBroker).
-		SetUsername(mqttUsername).
-		SetPassword(mqttPassword).
-		SetWill(fmt.Sprintf(mqttAvail, mqttSensor), "offline", 0, true). // Set the Will
-		SetAutoReconnect(true)
-
-	for i := 1; i <= maxRetries; i++ {
-		client := mqtt.NewClient(opts)
-		token := client.Connect()
-		token.Wait()
-
-		if token.Error() == nil {
-			log.Println("Connected to MQTT broker")
-			client.Publish(fmt.Sprintf(mqttAvail, mqttSensor), 0, true, "online").Wait() // Publish online status
-			return client
+	backfillDays := flag.Int("backfill-days", 0, "publish each sensor's value for the past N days to its backfill topic, and with HA_URL import them into Home Assistant's statistics, then exit")
+	discover := flag.Bool("discover-fields", false, "print the fields of the measurements the sensors read from, then exit")
+	replay := flag.Bool("replay", false, "with START STOP SPEED arguments, publish the readings between START and STOP at SPEED times real time, then exit")
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "":
+	case "test":
+		os.Exit(runSelfTest())
+	case "list-sensors":
+		loadConfig(configFile)
+		listSensors(os.Stdout)
+		return
+	case "export-ha-yaml":
+		loadConfig(configFile)
+		exportHAYAML(os.Stdout)
+		return
+	default:
+		if !*replay {
+			log.Fatalf("Unknown command %q", flag.Arg(0))
 		}
+	}
+	var replayStart, replayStop time.Time
+	var replaySpeed float64
+	if *replay {
+		var err error
+		if replayStart, replayStop, replaySpeed, err = parseReplayArgs(flag.Args()); err != nil {
+			log.Fatalf("Invalid --replay: %v", err)
+		}
+	}
 
-		log.Printf("Failed to connect to MQTT (attempt %d/%d): %v", i, maxRetries, token.Error())
-		time.Sleep(retryDelay)
+	log.Printf("Starting Weather Sensor MQTT Publisher %s...", version)
+
+	loadConfig(configFile)
+	checkUnits(sensors)
+	if lastValueFile != "" {
+		loadLastResults()
 	}
 
-	log.Fatal("Could not connect to MQTT broker after multiple attempts")
-	return nil
-}
+	if *discover {
+		os.Exit(discoverFields(os.Stdout))
+	}
 
-func main() {
-	setupLogging()
-	log.Println("Starting Weather Sensor MQTT Publisher...")
+	shutdownTracing := setupTracing()
+	defer shutdownTracing()
 
 	// Print environment variables for debugging
-	log.Printf("Connecting to InfluxDB at: %s (Org: %s, Bucket: %s)", influxURL, influxOrg, influxBucket)
-	log.Printf("Connecting to MQTT Broker: %s", mqttBroker)
+	log.Printf("Connecting to InfluxDB at: %s (Org: %s, Bucket: %s)", influxQueryURL, influxOrg, influxBucket)
+	checkInfluxAccess()
+	checkClockSkew()
+	for _, target := range mqttTargets {
+		log.Printf("Connecting to MQTT Broker: %s", target.Broker)
+	}
 
-	client := connectToMQTT()
-	defer client.Disconnect(250)
+	conns := connectAllMQTT()
+	defer disconnectAllMQTT(conns)
 
-	// Publish MQTT Discovery Config at startup
-	publishMqttConfig(client)
+	if *backfillDays > 0 {
+		if err := runBackfill(conns, *backfillDays); err != nil {
+			disconnectAllMQTT(conns)
+			log.Fatal(err)
+		}
+		return
+	}
+	if *replay {
+		publishMqttConfig(conns)
+		settleDiscovery()
+		runReplay(conns, replayStart, replayStop, replaySpeed)
+		return
+	}
 
-	// Launch background goroutine for publishing config every 12 hours
+	// Stop between loops on SIGINT or SIGTERM, so the stop event is sent and
+	// the brokers are disconnected cleanly
+	shutdown, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for {
-			time.Sleep(configPublishInterval)
-			log.Println("Republishing MQTT config...")
-			publishMqttConfig(client)
-		}
+		// A second signal kills the bridge without waiting for the loop
+		<-shutdown.Done()
+		stop()
 	}()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	publishEvent(conns, "start")
 
-	// Example usage
-	sensorType := extractSensorType(mqttMaxTempTopic)
-	fmt.Println(sensorType) // Output: temperature-max
+	// Publish MQTT Discovery Config at startup
+	publishMqttConfig(conns)
+	settleDiscovery()
+
+	// Launch background goroutine for publishing config every 12 hours
+	if republishConfigs {
+		go republishConfig(conns)
+	}
+	if availabilityInterval > 0 {
+		go publishAvailabilityHeartbeat(conns)
+	}
 
-	// Main loop: Publish sensor data every 2 minutes
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr)
+	}
+
+	// Main loop: Publish sensor data every publishInterval
 	log.Println("Entering MQTT publishing loop...")
+	startupRetriesLeft := startupRetries
 	for {
-		rainValue, err := queryInfluxDB("rain", "sum")
-		if err != nil {
-			log.Printf("Error querying rain data: %v", err)
+		loopStart := time.Now()
+		ok := true
+		if !inMaintenance(conns, loopStart) {
+			ok = publishCycle(conns)
 		}
 
-		windValue, err := queryInfluxDB("wind", "max")
-		if err != nil {
-			log.Printf("Error querying wind data: %v", err)
+		delay := loopDelay(time.Since(loopStart))
+		if startupRetriesLeft > 0 {
+			delay = startupDelay(ok, &startupRetriesLeft, delay)
 		}
-
-		windGustValue, err := queryInfluxDB("wind-gust", "max")
-		if err != nil {
-			log.Printf("Error querying wind gust data: %v", err)
+		select {
+		case <-shutdown.Done():
+			log.Println("Shutting down...")
+			publishEvent(conns, "stop")
+			return
+		case <-reload:
+			// The next loop starts straight away with the new sensors
+			reloadConfig(conns)
+		case <-time.After(delay):
 		}
+	}
+}
 
-		minTempValue, err := queryInfluxDB("temperature", "min")
-		if err != nil {
-			log.Printf("Error querying min temp data: %v", err)
+// Query every sensor and publish the results, reporting whether every query
+// and publish succeeded
+func publishCycle(conns []*mqttConnection) bool {
+	ctx, loopSpan := tracer.Start(context.Background(), "publish cycle")
+	loopRetries.Store(0)
+
+	values := make([][]float64, len(sensors))
+	skip := make([]bool, len(sensors))
+	noData := make([]bool, len(sensors))
+	stale := make([]bool, len(sensors))
+	var lastErr error
+	ok := true
+	for i, query := range queryAll(ctx, sensors) {
+		sensor, result, err := sensors[i], query.values, query.err
+		noData[i] = errors.Is(err, ErrNoData)
+
+		var publish bool
+		switch {
+		case noData[i]:
+			result, publish = noDataResult(sensor)
+		case err != nil:
+			logThrottled("querying "+sensor.Key+": "+err.Error(), "Error querying %s data: %v", sensor.Key, err)
+			queryFailuresMetric.add(1, "sensor", sensor.Key, "reason", queryErrorReason(err))
+			lastErr = fmt.Errorf("%s: %w", sensor.Key, err)
+			ok = false
+			// Still published, as 0 or the stored result
+			publish = true
+			if stored, found := storedResultFor(sensor); found {
+				log.Printf("Publishing the stored %s value from %s", sensor.Key, stored.Time.Format(time.RFC3339))
+				result, stale[i] = stored.Values, true
+			}
+		default:
+			if result, publish = checkValidRange(sensor, result); publish {
+				rememberResult(sensor, result)
+			}
+		}
+		skip[i] = !publish
+		if publish && err == nil {
+			checkAlert(conns, sensor, lastValue(result))
+			checkReset(sensor, lastValue(result))
 		}
+		values[i] = result
+	}
 
-		maxTempValue, err := queryInfluxDB("temperature", "max")
+	if combinedJSON {
+		_, span := tracer.Start(ctx, "publish combined")
+		err := publishCombinedJSON(conns, values, skip)
+		endSpan(span, err)
 		if err != nil {
-			log.Printf("Error querying max temp data: %v", err)
+			publishFailuresMetric.add(1)
+			ok = false
+			log.Printf("Error publishing combined data: %v", err)
 		}
-
-		minHumidityValue, err := queryInfluxDB("humidity", "min")
+	}
+	for i, sensor := range sensors {
+		// Sensors with their own state topic aren't part of the combined payload
+		if combinedJSON && !sensor.hasExternalTopic() || skip[i] {
+			continue
+		}
+		_, span := startSensorSpan(ctx, "publish", sensor)
+		err := publishSensor(conns, sensor, values[i])
+		endSpan(span, err)
 		if err != nil {
-			log.Printf("Error querying min humidity data: %v", err)
+			publishFailuresMetric.add(1, "sensor", sensor.Key)
+			ok = false
+			log.Printf("Error publishing %s data: %v", sensor.Key, err)
 		}
+	}
 
-		maxHumidityValue, err := queryInfluxDB("humidity", "max")
-		if err != nil {
-			log.Printf("Error querying max humidity data: %v", err)
+	if lastValueFile != "" {
+		if err := saveLastResults(); err != nil {
+			log.Printf("Error saving %s: %v", lastValueFile, err)
 		}
+		for i, sensor := range sensors {
+			if !skip[i] {
+				staleSensors[sensor.Key] = stale[i]
+			}
+		}
+	}
 
-		minPressureValue, err := queryInfluxDB("pressure", "min")
-		if err != nil {
-			log.Printf("Error querying min pressure data: %v", err)
+	// After the states, so a sensor coming back shows its new value
+	for i, sensor := range sensors {
+		if sensor.noDataBehavior() == "unavailable" {
+			if err := publishSensorAvailability(conns, sensor, !noData[i]); err != nil {
+				log.Printf("Error publishing %v", err)
+			}
 		}
+	}
 
-		maxPressureValue, err := queryInfluxDB("pressure", "max")
-		if err != nil {
-			log.Printf("Error querying max pressure data: %v", err)
+	for _, sensor := range sensors {
+		if sensor.hasAttributes() {
+			if err := publishAttributes(ctx, conns, sensor); err != nil {
+				log.Printf("Error publishing %s attributes: %v", sensor.Key, err)
+			}
 		}
+	}
 
-		publishToMQTT(client, mqttRainTopic, rainValue)
-		publishToMQTT(client, mqttWindTopic, windValue)
-		publishToMQTT(client, mqttWindGustTopic, windGustValue)
+	if errorSensor {
+		publishLastError(conns, lastErr)
+	}
+	if timeDriftSensor {
+		publishTimeDrift(ctx, conns)
+	}
+	if retrySensor {
+		publishRetries(conns)
+	}
+	publishAlertNumbers(conns)
+	loopSpan.End()
+	return ok
+}
 
-		publishToMQTT(client, mqttMinTempTopic, minTempValue)
-		publishToMQTT(client, mqttMaxTempTopic, maxTempValue)
+// Republish the discovery config every configPublishInterval. A panic in one
+// republish is logged and recovered, so it doesn't stop the later ones.
+func republishConfig(conns []*mqttConnection) {
+	for {
+		time.Sleep(configPublishInterval)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Panic republishing MQTT config, retrying in %s: %v\n%s", configPublishInterval, r, debug.Stack())
+				}
+			}()
+			log.Println("Republishing MQTT config...")
+			publishMqttConfig(conns)
+		}()
+	}
+}
 
-		publishToMQTT(client, mqttMinHumidTopic, minHumidityValue)
-		publishToMQTT(client, mqttMaxHumidTopic, maxHumidityValue)
+var (
+	loopDurationMetric    = newGauge("bridge_loop_duration_seconds", "Duration of the last publish loop.")
+	publishFailuresMetric = newCounter("bridge_publish_failures_total", "State publishes that failed on at least one broker.")
+	loopsBehindMetric     = newCounter("bridge_loops_behind_schedule_total", "Publish loops that took longer than MAX_LOOP_DURATION.")
+	queryFailuresMetric   = newCounter("bridge_query_failures_total", "Sensor queries that failed, by reason: auth, timeout or query.")
+	queryRetriesMetric    = newCounter("bridge_query_retries_total", "Query attempts repeated after a failed one, by query.")
+)
 
-		publishToMQTT(client, mqttMinPressureTopic, minPressureValue)
-		publishToMQTT(client, mqttMaxPressureTopic, maxPressureValue)
+// How long to wait before the next loop, so loops start every publishInterval
+// rather than drifting by the time spent querying. A loop that overran starts
+// the next one straight away.
+func loopDelay(elapsed time.Duration) time.Duration {
+	loopDurationMetric.set(elapsed.Seconds())
+	if elapsed > maxLoopDuration {
+		loopsBehindMetric.add(1)
+		log.Printf("Warning: publish loop took %s, longer than %s, running behind schedule", elapsed.Round(time.Millisecond), maxLoopDuration)
+	}
+	if elapsed >= publishInterval {
+		return 0
+	}
+	return max(publishInterval-elapsed+jitter(), 0)
+}
 
-		time.Sleep(publishInterval)
+// A random offset of up to ±publishJitter, so bridges started together don't
+// keep querying influxdb at the same moment
+func jitter() time.Duration {
+	if publishJitter == 0 {
+		return 0
 	}
+	return time.Duration(rand.Int64N(int64(2*publishJitter)+1)) - publishJitter
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestPublishMqttConfigOutsideLock(t *testing.T) {
+	published := make(chan brokerMessage, 100)
+	var conns []*mqttConnection
+	for range 2 {
+		target := mqttTarget{Broker: fakeBroker(t, published), ClientID: "bridge-test"}
+		client := mqtt.NewClient(newMqttOptions(target))
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+		t.Cleanup(func() { client.Disconnect(0) })
+		conns = append(conns, &mqttConnection{target: target, client: client})
+	}
+
+	defer func(current []Sensor) { sensors = current }(sensors)
+	configMu.Lock()
+	sensors = defaultSensors
+	entries := len(discoveryConfigs())
+	configMu.Unlock()
+
+	// A reload can take the lock while the configs are being published
+	done := make(chan struct{})
+	go func() {
+		publishMqttConfig(conns)
+		close(done)
+	}()
+	for received := 0; received < 2*entries; received++ {
+		select {
+		case <-published:
+			if !configMu.TryLock() {
+				t.Fatal("config lock held while publishing")
+			}
+			configMu.Unlock()
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d of %d configs published", received, 2*entries)
+		}
+	}
+	<-done
+}
+
+func TestPublishMqttConfigSkipsConnecting(t *testing.T) {
+	published := make(chan brokerMessage, 100)
+	target := mqttTarget{Broker: fakeBroker(t, published), ClientID: "bridge-test"}
+	client := mqtt.NewClient(newMqttOptions(target))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	up := &mqttConnection{target: target, client: client}
+
+	// A client that was never connected, like one still connecting in the
+	// background
+	downTarget := mqttTarget{Broker: "tcp://127.0.0.1:1", ClientID: "bridge-test"}
+	down := &mqttConnection{target: downTarget, client: mqtt.NewClient(newMqttOptions(downTarget))}
+
+	defer func(current []Sensor) { sensors = current }(sensors)
+	configMu.Lock()
+	sensors = defaultSensors
+	entries := len(discoveryConfigs())
+	configMu.Unlock()
+
+	start := time.Now()
+	publishMqttConfig([]*mqttConnection{up, down})
+	if elapsed := time.Since(start); elapsed > retryDelay {
+		t.Errorf("publishMqttConfig() took %s, want it not to retry the unconnected broker", elapsed)
+	}
+	receiveConfigs(t, published, entries)
+	if !down.discoveryPending {
+		t.Error("unconnected broker isn't marked for discovery on connect")
+	}
+
+	// Once it connects it gets the configs it missed
+	late := mqtt.NewClient(newMqttOptions(target))
+	if token := late.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() { late.Disconnect(0) })
+	down.connected(late)
+	receiveConfigs(t, published, entries)
+	if down.discoveryPending {
+		t.Error("discovery still pending after connecting")
+	}
+}
+
+func receiveConfigs(t *testing.T, published <-chan brokerMessage, entries int) {
+	t.Helper()
+	for received := 0; received < entries; received++ {
+		select {
+		case <-published:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d of %d configs published", received, entries)
+		}
+	}
+	select {
+	case msg := <-published:
+		t.Errorf("unexpected publish to %s", msg.topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A time of day range such as 02:00-02:30, which may run past midnight
+type dailyWindow struct {
+	start, end time.Duration // Since midnight
+}
+
+// MAINTENANCE_WINDOW, nil when unset, and whether the loop is paused in it.
+// The OnConnect handler reads maintenanceActive from paho's goroutine.
+var (
+	maintenance       *dailyWindow
+	maintenanceActive atomic.Bool
+)
+
+func parseDailyWindow(value string) (*dailyWindow, error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("start: %v", err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("end: %v", err)
+	}
+	if start.Equal(end) {
+		return nil, fmt.Errorf("start and end are the same time")
+	}
+	return &dailyWindow{sinceMidnight(start), sinceMidnight(end)}, nil
+}
+
+// The wall clock time of t, so the window moves with daylight saving
+func sinceMidnight(t time.Time) time.Duration {
+	hour, minute, second := t.Clock()
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second
+}
+
+func (w dailyWindow) contains(t time.Time) bool {
+	clock := sinceMidnight(t)
+	if w.start < w.end {
+		return clock >= w.start && clock < w.end
+	}
+	return clock >= w.start || clock < w.end
+}
+
+// Whether the loop should skip querying because now is in the maintenance
+// window. Sensors are marked unavailable on the way in. On the way out the
+// next state publish marks them online again, except in lwt_only mode or
+// with AVAILABILITY_INTERVAL where online is published here.
+func inMaintenance(conns []*mqttConnection, now time.Time) bool {
+	if maintenance == nil {
+		return false
+	}
+	active := maintenance.contains(now)
+	if active == maintenanceActive.Load() {
+		return active
+	}
+	maintenanceActive.Store(active)
+
+	if active {
+		log.Printf("Entering maintenance window %s, pausing queries", maintenanceWindow)
+		if err := publishAll(conns, fmt.Sprintf(mqttAvail, mqttSensor), availabilityQoS, true, availabilityPayload("offline")); err != nil {
+			log.Printf("Error marking sensors unavailable for maintenance: %v", err)
+		}
+		return true
+	}
+	log.Printf("Maintenance window %s over, resuming queries", maintenanceWindow)
+	if availabilityMode == "lwt_only" || availabilityInterval > 0 {
+		if err := publishAll(conns, fmt.Sprintf(mqttAvail, mqttSensor), availabilityQoS, true, availabilityPayload("online")); err != nil {
+			log.Printf("Error marking sensors available after maintenance: %v", err)
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A counter or gauge exposed in the Prometheus text format on METRICS_ADDR
+type metric struct {
+	name string
+	help string
+	kind string // counter or gauge
+
+	mu     sync.Mutex
+	values map[string]float64 // Keyed by rendered labels, e.g. sensor="rain"
+}
+
+var registeredMetrics []*metric
+
+func newMetric(kind, name, help string) *metric {
+	m := &metric{name: name, help: help, kind: kind, values: map[string]float64{}}
+	registeredMetrics = append(registeredMetrics, m)
+	return m
+}
+
+func newCounter(name, help string) *metric { return newMetric("counter", name, help) }
+func newGauge(name, help string) *metric   { return newMetric("gauge", name, help) }
+
+// Labels are given as name, value pairs
+func renderLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metric) add(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[renderLabels(labels)] += v
+}
+
+func (m *metric) set(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[renderLabels(labels)] = v
+}
+
+func (m *metric) write(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "" {
+			fmt.Fprintf(sb, "%s %g\n", m.name, m.values[k])
+		} else {
+			fmt.Fprintf(sb, "%s{%s} %g\n", m.name, k, m.values[k])
+		}
+	}
+}
+
+// Serve /metrics in the background
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var sb strings.Builder
+		for _, m := range registeredMetrics {
+			m.write(&sb)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, sb.String())
+	})
+
+	go func() {
+		log.Printf("Serving metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A broker that sensor data is published to
+type mqttTarget struct {
+	Broker   string
+	Username string
+	Password string
+	ClientID string
+}
+
+// A connected client for one broker target
+type mqttConnection struct {
+	target mqttTarget
+
+	mu            sync.Mutex
+	client        mqtt.Client
+	failures      int  // Consecutive failed publishes, see recordPublish
+	watchdogFired bool // The watchdog reconnected during these failures
+
+	discoveryPending bool // Discovery was skipped while connecting, see connected
+}
+
+// Called from the OnConnect handler. Discovery configs that were skipped
+// because the broker was still connecting are published now. The client is
+// stored first, the OnConnect handler can run before connectAllMQTT or
+// reconnect have stored it.
+func (c *mqttConnection) connected(client mqtt.Client) {
+	c.mu.Lock()
+	c.client = client
+	pending := c.discoveryPending
+	c.discoveryPending = false
+	c.mu.Unlock()
+
+	if pending {
+		log.Printf("Publishing the discovery configs that %s missed while connecting", c.target.Broker)
+		publishDiscoveryConfigs(c, snapshotDiscoveryConfigs())
+	}
+}
+
+// Report whether the broker is connected. Otherwise the discovery configs are
+// left to connected.
+func (c *mqttConnection) readyForDiscovery() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client.IsConnectionOpen() {
+		return true
+	}
+	c.discoveryPending = true
+	return false
+}
+
+// Publish and wait for the broker to acknowledge, failing after publishTimeout
+func (c *mqttConnection) publish(topic string, qos byte, retained bool, payload interface{}) error {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+
+	// Still connecting or reconnecting, which paho takes care of. Queued
+	// publishes would only time out, and aren't the watchdog's business.
+	if !client.IsConnectionOpen() {
+		return errors.New("not connected")
+	}
+	token := client.Publish(topic, qos, retained, payload)
+	var err error
+	if !token.WaitTimeout(publishTimeout) {
+		err = fmt.Errorf("timed out after %s", publishTimeout)
+	} else {
+		err = token.Error()
+	}
+	c.recordPublish(err)
+	return err
+}
+
+// Watchdog for connections that paho reports as connected but where publishes
+// stall. After mqttWatchdogThreshold consecutive failures the client is
+// replaced with a freshly connected one, once per run of failures. The
+// reconnect runs in the background, publishes fail as not connected until it
+// is done.
+func (c *mqttConnection) recordPublish(err error) {
+	c.mu.Lock()
+	if err == nil {
+		if c.failures > 0 {
+			log.Printf("Publishing to %s recovered after %d failures", c.target.Broker, c.failures)
+		}
+		c.failures = 0
+		c.watchdogFired = false
+		c.mu.Unlock()
+		return
+	}
+
+	c.failures++
+	if mqttWatchdogThreshold <= 0 || c.failures < mqttWatchdogThreshold || c.watchdogFired {
+		c.mu.Unlock()
+		return
+	}
+	c.watchdogFired = true
+	failures, old := c.failures, c.client
+	c.mu.Unlock()
+
+	log.Printf("Watchdog: %d consecutive publish failures on %s, forcing reconnect", failures, c.target.Broker)
+	go c.reconnect(old)
+}
+
+// Replace the client with a newly connected one. The old one is disconnected
+// first: with a fixed client ID the new connection would take over its
+// session, the broker would send its Will and paho would reconnect the old
+// client. A clean disconnect sends no Will, and the new client publishes
+// online as it connects.
+func (c *mqttConnection) reconnect(old mqtt.Client) {
+	old.Disconnect(250)
+	client, err := tryConnectMQTT(c.target, c.connected)
+	if err != nil {
+		logThrottled("watchdog "+c.target.Broker+": "+err.Error(), "Watchdog: reconnect to %s failed, connecting in the background: %v", c.target.Broker, err)
+		client = connectInBackground(c.target, c.connected)
+	}
+
+	c.mu.Lock()
+	c.client = client
+	c.failures = 0
+	c.mu.Unlock()
+}
+
+// Load the broker targets. MQTT_BROKER, MQTT_USERNAME and MQTT_PASSWORD define
+// the first broker, further brokers are added with numbered variables
+// (MQTT_BROKER_2, MQTT_USERNAME_2, MQTT_PASSWORD_2, MQTT_CLIENT_ID_2, ...).
+// A numbered broker without its own credentials or client ID uses the
+// unnumbered ones.
+func loadMqttTargets() []mqttTarget {
+	clientID := getEnv("MQTT_CLIENT_ID", "")
+	targets := []mqttTarget{{Broker: mqttBroker, Username: mqttUsername, Password: mqttPassword, ClientID: clientID}}
+
+	for i := 2; ; i++ {
+		broker, exists := os.LookupEnv(fmt.Sprintf("MQTT_BROKER_%d", i))
+		if !exists || strings.TrimSpace(broker) == "" {
+			break
+		}
+		targets = append(targets, mqttTarget{
+			Broker:   broker,
+			Username: getEnv(fmt.Sprintf("MQTT_USERNAME_%d", i), mqttUsername),
+			Password: getEnv(fmt.Sprintf("MQTT_PASSWORD_%d", i), mqttPassword),
+			ClientID: getEnv(fmt.Sprintf("MQTT_CLIENT_ID_%d", i), clientID),
+		})
+	}
+	return targets
+}
+
+// Publish a message to every broker, waiting for each publish to complete
+func publishAll(conns []*mqttConnection, topic string, qos byte, retained bool, payload interface{}) error {
+	var errs []error
+	for _, c := range conns {
+		if err := c.publish(topic, qos, retained, payload); err != nil {
+			logThrottled("publish "+c.target.Broker+": "+err.Error(), "Failed to publish to %s on %s: %v", topic, c.target.Broker, err)
+			errs = append(errs, fmt.Errorf("%s: %w", c.target.Broker, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Publish a message to every broker, retrying a failed broker like a failed
+// connect. Used for messages that must arrive, such as the events and the
+// removal of discovery configs.
+func publishAllWithRetry(conns []*mqttConnection, topic string, qos byte, retained bool, payload interface{}) error {
+	var errs []error
+	for _, c := range conns {
+		if err := c.publishWithRetry(topic, qos, retained, payload); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.target.Broker, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Publish a message once to every broker that is connected, skipping the
+// others. Each publish still waits up to publishTimeout.
+func publishConnected(conns []*mqttConnection, topic string, qos byte, retained bool, payload interface{}) error {
+	var connected []*mqttConnection
+	for _, c := range conns {
+		if c.isConnected() {
+			connected = append(connected, c)
+		} else {
+			log.Printf("Skipping %s on %s, not connected", topic, c.target.Broker)
+		}
+	}
+	return publishAll(connected, topic, qos, retained, payload)
+}
+
+func (c *mqttConnection) isConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client.IsConnectionOpen()
+}
+
+func (c *mqttConnection) publishWithRetry(topic string, qos byte, retained bool, payload interface{}) error {
+	var err error
+	for i := 1; i <= maxRetries; i++ {
+		if err = c.publish(topic, qos, retained, payload); err == nil {
+			return nil
+		}
+		log.Printf("Failed to publish to %s on %s (attempt %d/%d): %v", topic, c.target.Broker, i, maxRetries, err)
+		if i < maxRetries {
+			time.Sleep(retryDelay)
+		}
+	}
+	return err
+}
+
+// Publish a state payload and then mark the device online. Availability is
+// only published to a broker once the state has been delivered to it, so a
+// failed state publish doesn't leave the entity online with a stale value.
+// Each publish is waited for before the next, so a broker receives the state
+// before the availability whatever MQTT_ORDER_MATTERS is set to.
+// With AVAILABILITY_MODE=lwt_only online is only sent on connect and the
+// Will and expire_after take care of the rest, with AVAILABILITY_INTERVAL it
+// is sent on its own timer.
+func publishState(conns []*mqttConnection, topic string, payload interface{}) error {
+	var errs []error
+	for _, c := range conns {
+		if err := c.publish(topic, stateQoS, false, payload); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.target.Broker, err))
+			recordDeadLetter(c.target.Broker, topic, payload, err)
+			continue
+		}
+		if availabilityMode == "lwt_only" || availabilityInterval > 0 {
+			continue
+		}
+		if err := c.publish(fmt.Sprintf(mqttAvail, mqttSensor), availabilityQoS, true, availabilityPayload("online")); err != nil {
+			errs = append(errs, fmt.Errorf("%s availability: %w", c.target.Broker, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Publish data to MQTT
+func publishToMQTT(conns []*mqttConnection, topic string, payload string) error {
+	if err := publishState(conns, topic, payload); err != nil {
+		return err
+	}
+	log.Printf("Published to %s: %s", topic, payload)
+	return nil
+}
+
+// Publish a sensor's query result, either its latest value or, for sensors
+// publishing windows as an array, every window value
+func publishSensor(conns []*mqttConnection, sensor Sensor, values []float64) error {
+	if !sensor.publishesArray() {
+		return publishToMQTT(conns, sensor.stateTopic(), sensor.formatValue(lastValue(values)))
+	}
+
+	data, err := json.Marshal(sensor.formatArray(values))
+	if err != nil {
+		return fmt.Errorf("marshalling %s values: %v", sensor.Key, err)
+	}
+	return publishToMQTT(conns, sensor.stateTopic(), string(data))
+}
+
+func (s Sensor) formatArray(values []float64) []json.Number {
+	result := make([]json.Number, len(values))
+	for i, v := range values {
+		result[i] = json.Number(s.formatNumber(v))
+	}
+	return result
+}
+
+// Publish all sensor values as a single JSON object, keyed by each sensor's
+// JSON key and nested in an object for sensors with a JSON group. values and
+// skip are indexed the same as sensors, skipped sensors are left out.
+func publishCombinedJSON(conns []*mqttConnection, values [][]float64, skip []bool) error {
+	payload := make(map[string]interface{}, len(sensors))
+	for i, sensor := range sensors {
+		if sensor.hasExternalTopic() || skip[i] {
+			continue
+		}
+		target := payload
+		if sensor.JSONGroup != "" {
+			group, ok := payload[sensor.JSONGroup].(map[string]interface{})
+			if !ok {
+				group = make(map[string]interface{})
+				payload[sensor.JSONGroup] = group
+			}
+			target = group
+		}
+
+		if sensor.publishesArray() {
+			target[sensor.jsonKey()] = sensor.formatArray(values[i])
+		} else if sensor.publishesText() {
+			target[sensor.jsonKey()] = sensor.formatValue(lastValue(values[i]))
+		} else {
+			target[sensor.jsonKey()] = json.Number(sensor.formatNumber(lastValue(values[i])))
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshalling combined payload: %v", err)
+	}
+	return publishToMQTT(conns, fmt.Sprintf(mqttCombinedStateTopic, mqttSensor), string(data))
+}
+
+// Broker URL schemes and the transport they use
+var brokerTransports = map[string]string{
+	"tcp": "tcp", "mqtt": "tcp",
+	"ssl": "tls", "tls": "tls", "mqtts": "tls",
+	"ws": "websocket", "wss": "websocket+tls",
+}
+
+// Check every broker URL has a supported scheme, and a client ID when the
+// session is kept
+func validateMqttTargets(targets []mqttTarget) error {
+	for _, target := range targets {
+		if _, err := brokerTransport(target.Broker); err != nil {
+			return err
+		}
+		if !mqttCleanSession && target.ClientID == "" {
+			return fmt.Errorf("MQTT_CLEAN_SESSION=false needs a client ID for %s, set MQTT_CLIENT_ID", target.Broker)
+		}
+	}
+	return nil
+}
+
+func brokerTransport(broker string) (string, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", fmt.Errorf("invalid MQTT broker URL %q: %v", broker, err)
+	}
+	transport, ok := brokerTransports[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("unsupported MQTT broker scheme %q in %s, use tcp://, ssl://, ws:// or wss://", u.Scheme, broker)
+	}
+	return transport, nil
+}
+
+// Default ports for tcp and tls brokers given without one, e.g. ssl://broker
+var defaultBrokerPorts = map[string]string{"tcp": "1883", "tls": "8883"}
+
+func brokerWithDefaultPort(broker string) string {
+	u, err := url.Parse(broker)
+	if err != nil || u.Port() != "" {
+		return broker
+	}
+	transport, _ := brokerTransport(broker)
+	if port, ok := defaultBrokerPorts[transport]; ok {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+		return u.String()
+	}
+	return broker
+}
+
+// TLS settings shared by every tls and wss broker, see loadMqttTLSConfig
+var mqttTLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+// Load the TLS settings for client certificate authentication and ALPN, as
+// needed for AWS IoT Core. MQTT_TLS_CA_FILE replaces the system roots,
+// MQTT_TLS_CERT_FILE and MQTT_TLS_KEY_FILE are a PEM client certificate and
+// key and MQTT_TLS_ALPN is a comma separated list of protocols.
+func loadMqttTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile := getEnv("MQTT_TLS_CA_FILE", ""); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading MQTT_TLS_CA_FILE: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in MQTT_TLS_CA_FILE %s", caFile)
+		}
+	}
+
+	certFile, keyFile := getEnv("MQTT_TLS_CERT_FILE", ""), getEnv("MQTT_TLS_KEY_FILE", "")
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("MQTT_TLS_CERT_FILE and MQTT_TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading MQTT client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	for _, proto := range strings.Split(getEnv("MQTT_TLS_ALPN", ""), ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			config.NextProtos = append(config.NextProtos, proto)
+		}
+	}
+	return config, nil
+}
+
+func newMqttOptions(target mqttTarget) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions().
+		AddBroker(brokerWithDefaultPort(target.Broker)).
+		SetUsername(target.Username).
+		SetPassword(target.Password).
+		SetClientID(target.ClientID).
+		SetCleanSession(mqttCleanSession).
+		SetOrderMatters(mqttOrderMatters).
+		SetWriteTimeout(publishTimeout).
+		SetWill(fmt.Sprintf(mqttAvail, mqttSensor), availabilityPayload("offline"), availabilityQoS, true). // Set the Will
+		SetAutoReconnect(true)
+
+	transport, _ := brokerTransport(target.Broker)
+	if strings.HasPrefix(transport, "websocket") {
+		websocketProxy := http.ProxyFromEnvironment
+		if mqttSocksProxy != nil {
+			// The websocket client only knows the socks5 scheme, which
+			// also leaves resolving the broker's name to the proxy
+			socks := *mqttSocksProxy
+			socks.Scheme = "socks5"
+			websocketProxy = http.ProxyURL(&socks)
+		}
+		opts.SetWebsocketOptions(&mqtt.WebsocketOptions{Proxy: websocketProxy})
+	} else if mqttSocksProxy != nil {
+		opts.SetCustomOpenConnectionFn(socksOpenConnection(mqttSocksProxy))
+	}
+	if strings.HasSuffix(transport, "tls") {
+		opts.SetTLSConfig(mqttTLSConfig.Clone())
+	}
+	return opts
+}
+
+// Connect to MQTT with retry mechanism. Online is published from the
+// OnConnect handler, so it is re-asserted as soon as paho reconnects after a
+// dropped connection has set the Will. onConnect, if set, is called with the
+// client from the handler.
+func tryConnectMQTT(target mqttTarget, onConnect func(mqtt.Client)) (mqtt.Client, error) {
+	opts := connectOptions(target, onConnect)
+	for i := 1; i <= maxRetries; i++ {
+		client := mqtt.NewClient(opts)
+		token := client.Connect()
+		token.Wait()
+
+		if token.Error() == nil {
+			log.Printf("Connected to MQTT broker %s", target.Broker)
+			return client, nil
+		}
+
+		logThrottled("connect "+target.Broker+": "+token.Error().Error(), "Failed to connect to MQTT %s (attempt %d/%d): %v", target.Broker, i, maxRetries, token.Error())
+		time.Sleep(retryDelay)
+	}
+
+	return nil, fmt.Errorf("could not connect to MQTT broker %s after multiple attempts", target.Broker)
+}
+
+func connectOptions(target mqttTarget, onConnect func(mqtt.Client)) *mqtt.ClientOptions {
+	opts := newMqttOptions(target).SetOnConnectHandler(func(client mqtt.Client) {
+		status := "online"
+		if maintenanceActive.Load() {
+			status = "offline" // Stays unavailable until the maintenance window is over
+		}
+		token := client.Publish(fmt.Sprintf(mqttAvail, mqttSensor), availabilityQoS, true, availabilityPayload(status))
+		if token.WaitTimeout(publishTimeout) && token.Error() != nil {
+			log.Printf("Failed to publish %s status to %s: %v", status, target.Broker, token.Error())
+		}
+		subscribeAlertNumbers(client, target.Broker)
+		if onConnect != nil {
+			onConnect(client)
+		}
+	})
+	opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+		log.Printf("Reconnecting to MQTT broker %s", target.Broker)
+	})
+	return opts
+}
+
+// Keep connecting to a broker that couldn't be reached at startup in the
+// background, every retryDelay, the way paho reconnects a dropped
+// connection. Publishes to it fail until it is connected.
+func connectInBackground(target mqttTarget, onConnect func(mqtt.Client)) mqtt.Client {
+	opts := connectOptions(target, onConnect).SetConnectRetry(true).SetConnectRetryInterval(retryDelay)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	go func() {
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("Stopped connecting to MQTT broker %s: %v", target.Broker, token.Error())
+			return
+		}
+		log.Printf("Connected to MQTT broker %s", target.Broker)
+	}()
+	return client
+}
+
+// Connect to every broker target. Each client has its own Will, so the
+// availability of one broker does not affect the others. A broker that can't
+// be reached doesn't stop the others from being published to.
+func connectAllMQTT() []*mqttConnection {
+	conns := make([]*mqttConnection, 0, len(mqttTargets))
+	for _, target := range mqttTargets {
+		c := &mqttConnection{target: target}
+		client, err := tryConnectMQTT(target, c.connected)
+		if err != nil {
+			log.Printf("%v, connecting in the background", err)
+			client = connectInBackground(target, c.connected)
+		}
+		c.mu.Lock()
+		c.client = client
+		c.mu.Unlock()
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Mark the bridge offline on every broker and disconnect. A clean disconnect
+// doesn't send the Will, so offline is published first and waited for.
+func disconnectAllMQTT(conns []*mqttConnection) {
+	for _, c := range conns {
+		c.mu.Lock()
+		if c.client.IsConnectionOpen() {
+			token := c.client.Publish(fmt.Sprintf(mqttAvail, mqttSensor), availabilityQoS, true, availabilityPayload("offline"))
+			if !token.WaitTimeout(publishTimeout) {
+				log.Printf("Failed to publish offline status to %s: timed out after %s", c.target.Broker, publishTimeout)
+			} else if token.Error() != nil {
+				log.Printf("Failed to publish offline status to %s: %v", c.target.Broker, token.Error())
+			}
+		}
+		c.client.Disconnect(250)
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A message a fake broker received
+type brokerMessage struct {
+	topic, payload string
+	retained       bool
+}
+
+// A broker that accepts connections and answers pings. Without a channel it
+// never acknowledges a publish, like a broker whose connection has stalled.
+// With one every publish is acknowledged and sent to it.
+func fakeBroker(t *testing.T, published chan<- brokerMessage) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFake(conn, published)
+		}
+	}()
+	return "tcp://" + listener.Addr().String()
+}
+
+// Serve one client until it disconnects
+func serveFake(conn net.Conn, published chan<- brokerMessage) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		// The remaining length, a variable length integer
+		length, shift := 0, 0
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length |= int(b&0x7f) << shift
+			shift += 7
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT, accepted
+			conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		case 3: // PUBLISH
+			if published == nil {
+				continue
+			}
+			topicEnd := 2 + (int(body[0])<<8 | int(body[1]))
+			payload, qos := body[topicEnd:], header>>1&3
+			var packetID []byte
+			if qos > 0 {
+				packetID, payload = payload[:2], payload[2:]
+			}
+			// Received before it is acknowledged
+			published <- brokerMessage{string(body[2:topicEnd]), string(payload), header&1 == 1}
+			if qos > 0 {
+				conn.Write([]byte{0x40, 0x02, packetID[0], packetID[1]}) // PUBACK
+			}
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0x00})
+		}
+	}
+}
+
+func silentConnection(t *testing.T) *mqttConnection {
+	t.Helper()
+	target := mqttTarget{Broker: fakeBroker(t, nil), ClientID: "bridge-test"}
+	// Without tryConnectMQTT's OnConnect handler, which would still be
+	// reading publishTimeout when the test restores it
+	client := mqtt.NewClient(newMqttOptions(target))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return &mqttConnection{target: target, client: client}
+}
+
+func setPublishTimeout(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	previousTimeout, previousThreshold := publishTimeout, mqttWatchdogThreshold
+	publishTimeout = timeout
+	mqttWatchdogThreshold = 0 // Keep the watchdog from replacing the client
+	t.Cleanup(func() { publishTimeout, mqttWatchdogThreshold = previousTimeout, previousThreshold })
+}
+
+func TestPublishTimesOut(t *testing.T) {
+	setPublishTimeout(t, 200*time.Millisecond)
+	c := silentConnection(t)
+
+	start := time.Now()
+	err := c.publish("homeassistant/sensor/test/state", 1, false, "1.0")
+	elapsed := time.Since(start)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("publish() = %v, want a timeout", err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("publish() took %s, want about %s", elapsed, publishTimeout)
+	}
+	if c.failures != 1 {
+		t.Errorf("failures = %d, want 1", c.failures)
+	}
+
+	// QoS 0 isn't acknowledged, so it completes once it is written
+	if err := c.publish("homeassistant/sensor/test/state", 0, false, "1.0"); err != nil {
+		t.Errorf("QoS 0 publish() = %v, want nil", err)
+	}
+	if c.failures != 0 {
+		t.Errorf("failures after a delivered publish = %d, want 0", c.failures)
+	}
+}
+
+func TestPublishStateTimesOut(t *testing.T) {
+	setPublishTimeout(t, 200*time.Millisecond)
+	defer func(qos byte) { stateQoS = qos }(stateQoS)
+	stateQoS = 1
+	c := silentConnection(t)
+
+	// Availability isn't published after a state that wasn't acknowledged
+	err := publishState([]*mqttConnection{c}, "homeassistant/sensor/test/state", "1.0")
+	if err == nil || !strings.Contains(err.Error(), c.target.Broker) {
+		t.Fatalf("publishState() = %v, want a timeout on %s", err, c.target.Broker)
+	}
+	if c.failures != 1 {
+		t.Errorf("failures = %d, want 1", c.failures)
+	}
+}
+
+func TestDisconnectPublishesOffline(t *testing.T) {
+	published := make(chan brokerMessage, 10)
+	target := mqttTarget{Broker: fakeBroker(t, published), ClientID: "bridge-test"}
+	client := mqtt.NewClient(newMqttOptions(target))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	disconnectAllMQTT([]*mqttConnection{{target: target, client: client}})
+	want := brokerMessage{fmt.Sprintf(mqttAvail, mqttSensor), availabilityPayload("offline"), true}
+	select {
+	case got := <-published:
+		if got != want {
+			t.Errorf("published %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nothing published before disconnecting")
+	}
+	if client.IsConnected() {
+		t.Error("client still connected")
+	}
+}
+
+func TestConnectInBackground(t *testing.T) {
+	// A port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := mqttTarget{Broker: "tcp://" + listener.Addr().String(), ClientID: "bridge-test"}
+	listener.Close()
+
+	c := &mqttConnection{target: down, client: connectInBackground(down, nil)}
+	t.Cleanup(func() { c.client.Disconnect(0) })
+	start := time.Now()
+	err = c.publish("homeassistant/sensor/test/state", 1, false, "1.0")
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("publish() to a broker that is down = %v after %s, want a quick error", err, time.Since(start))
+	}
+	if c.failures != 0 {
+		t.Errorf("failures = %d, want 0, the watchdog leaves connecting to paho", c.failures)
+	}
+
+	// A broker that is up is connected to straight away
+	up := mqttTarget{Broker: fakeBroker(t, make(chan brokerMessage, 10)), ClientID: "bridge-test"}
+	client := connectInBackground(up, nil)
+	t.Cleanup(func() { client.Disconnect(0) })
+	deadline := time.Now().Add(2 * time.Second)
+	for !client.IsConnectionOpen() {
+		if time.Now().After(deadline) {
+			t.Fatal("not connected to the broker that is up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchdogReconnectsOncePerOutage(t *testing.T) {
+	defer func(threshold int) { mqttWatchdogThreshold = threshold }(mqttWatchdogThreshold)
+	mqttWatchdogThreshold = 2
+	c := silentConnection(t)
+	t.Cleanup(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.client.Disconnect(0)
+	})
+	current := func() mqtt.Client {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.client
+	}
+	replaced := func(old mqtt.Client) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for current() == old {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return true
+	}
+	stalled := errors.New("timed out")
+
+	// The reconnect doesn't hold the lock, recordPublish returns straight away
+	old := current()
+	c.recordPublish(stalled)
+	c.recordPublish(stalled)
+	if !replaced(old) {
+		t.Fatal("client not replaced after the threshold")
+	}
+	if old.IsConnected() {
+		t.Error("old client still connected")
+	}
+
+	// More failures in the same outage leave the new client alone
+	next := current()
+	for range 4 {
+		c.recordPublish(stalled)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if current() != next {
+		t.Error("watchdog reconnected twice in one outage")
+	}
+
+	// A delivered publish ends the outage
+	c.recordPublish(nil)
+	c.recordPublish(stalled)
+	c.recordPublish(stalled)
+	if !replaced(next) {
+		t.Error("client not replaced in the next outage")
+	}
+}
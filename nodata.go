@@ -0,0 +1,55 @@
+package main
+
+import "fmt"
+
+// What a sensor publishes when its query returns no rows
+var noDataBehaviors = map[string]bool{"zero": true, "unavailable": true, "last_value": true, "skip": true}
+
+// The last result with rows of each sensor, published again by last_value
+// sensors while their query returns none and kept in LAST_VALUE_FILE
+var lastResults = map[string]storedResult{}
+
+// The sensor's no_data_behavior. Computed sensors skip by default, a formula
+// of missing readings has no meaningful value.
+func (s Sensor) noDataBehavior() string {
+	if s.NoDataBehavior != "" {
+		return s.NoDataBehavior
+	}
+	if s.Compute != "" {
+		return "skip"
+	}
+	return "zero"
+}
+
+// The values to publish for a sensor whose query returned no rows, and
+// whether to publish them. zero publishes 0 (an empty array for array
+// sensors). last_value publishes the last result with rows, nothing until
+// there is one. unavailable and skip publish nothing.
+func noDataResult(sensor Sensor) ([]float64, bool) {
+	switch sensor.noDataBehavior() {
+	case "last_value":
+		previous, ok := lastResults[sensor.Key]
+		return previous.Values, ok
+	case "unavailable", "skip":
+		return nil, false
+	}
+	return nil, true
+}
+
+func (s Sensor) availabilityTopic() string {
+	return s.stateTopic() + "/availability"
+}
+
+// Mark a sensor with no_data_behavior unavailable online while its query
+// returns rows and offline while it doesn't. The device's availability still
+// applies, the discovery config needs both to be online.
+func publishSensorAvailability(conns []*mqttConnection, sensor Sensor, available bool) error {
+	payload := "offline"
+	if available {
+		payload = "online"
+	}
+	if err := publishAll(conns, sensor.availabilityTopic(), availabilityQoS, true, payload); err != nil {
+		return fmt.Errorf("%s availability: %w", sensor.Key, err)
+	}
+	return nil
+}
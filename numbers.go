@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Range of a number entity adjusting a sensor's alert threshold from Home
+// Assistant
+type alertNumber struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Step float64 `json:"step"`
+}
+
+// Alert thresholds changed from Home Assistant, by sensor key. They replace
+// the configured alert_threshold until the bridge restarts, or for as long as
+// the broker keeps the retained command.
+var alertThresholds = make(map[string]float64)
+
+// The sensor's current alert threshold
+func (s Sensor) alertThreshold() float64 {
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+	if threshold, ok := alertThresholds[s.Key]; ok {
+		return threshold
+	}
+	return *s.AlertThreshold
+}
+
+// Topics of a sensor's alert threshold number, MQTT_SENSOR, sensor key and
+// config, state or set
+const mqttAlertNumberTopic = "homeassistant/number/%s/%s-alert-threshold/%s"
+
+func (s Sensor) alertNumberTopic(suffix string) string {
+	return fmt.Sprintf(mqttAlertNumberTopic, mqttSensor, s.Key, suffix)
+}
+
+func alertNumberConfig(device Device, sensor Sensor) MqttConfig {
+	step := sensor.AlertNumber.Step
+	if step == 0 {
+		step = 1
+	}
+	config := MqttConfig{
+		Name:              sensor.Name + " Alert Threshold",
+		StateTopic:        sensor.alertNumberTopic("state"),
+		CommandTopic:      sensor.alertNumberTopic("set"),
+		UnitOfMeasurement: sensor.Unit,
+		UniqueID:          fmt.Sprintf("%s-number-%s-alert-threshold", mqttSensor, sensor.Key),
+		ObjectID:          objectID(sensor.Key + "-alert-threshold"),
+		Min:               &sensor.AlertNumber.Min,
+		Max:               &sensor.AlertNumber.Max,
+		Step:              step,
+		Mode:              "box",
+		Retain:            true, // The broker keeps the last setting over restarts
+		EntityCategory:    "config",
+		Device:            device,
+	}
+	setAvailability(&config)
+	return config
+}
+
+// Subscribe to the command topics of the alert threshold numbers, called on
+// every connect since the subscriptions don't outlive a clean session
+func subscribeAlertNumbers(client mqtt.Client, broker string) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	for _, sensor := range sensors {
+		if sensor.AlertNumber == nil {
+			continue
+		}
+		token := client.Subscribe(sensor.alertNumberTopic("set"), 1, func(client mqtt.Client, msg mqtt.Message) {
+			setAlertThreshold(client, sensor, string(msg.Payload()))
+		})
+		if token.WaitTimeout(publishTimeout) && token.Error() != nil {
+			log.Printf("Failed to subscribe to %s on %s: %v", sensor.alertNumberTopic("set"), broker, token.Error())
+		}
+	}
+}
+
+// After a config reload, unsubscribe from the alert numbers of the old
+// sensors that are gone and subscribe to the new ones on every broker
+func resubscribeAlertNumbers(conns []*mqttConnection, old []Sensor) {
+	current := make(map[string]bool)
+	for _, sensor := range sensors {
+		if sensor.AlertNumber != nil {
+			current[sensor.alertNumberTopic("set")] = true
+		}
+	}
+	for _, c := range conns {
+		c.mu.Lock()
+		client := c.client
+		c.mu.Unlock()
+		for _, sensor := range old {
+			if topic := sensor.alertNumberTopic("set"); sensor.AlertNumber != nil && !current[topic] {
+				if token := client.Unsubscribe(topic); token.WaitTimeout(publishTimeout) && token.Error() != nil {
+					log.Printf("Failed to unsubscribe from %s on %s: %v", topic, c.target.Broker, token.Error())
+				}
+			}
+		}
+		subscribeAlertNumbers(client, c.target.Broker)
+	}
+}
+
+// Apply a threshold sent from Home Assistant and confirm it on the state topic
+func setAlertThreshold(client mqtt.Client, sensor Sensor, payload string) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(payload), 64)
+	if err != nil || value < sensor.AlertNumber.Min || value > sensor.AlertNumber.Max {
+		log.Printf("Ignoring %s alert threshold %q, expected a number from %g to %g", sensor.Key, payload, sensor.AlertNumber.Min, sensor.AlertNumber.Max)
+		return
+	}
+
+	alertsMu.Lock()
+	alertThresholds[sensor.Key] = value
+	alertsMu.Unlock()
+	log.Printf("Alert threshold of %s set to %g", sensor.Key, value)
+
+	client.Publish(sensor.alertNumberTopic("state"), 0, true, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// Publish the current alert thresholds, so every broker shows the value in use
+func publishAlertNumbers(conns []*mqttConnection) {
+	for _, sensor := range sensors {
+		if sensor.AlertNumber == nil {
+			continue
+		}
+		value := strconv.FormatFloat(sensor.alertThreshold(), 'f', -1, 64)
+		if err := publishAll(conns, sensor.alertNumberTopic("state"), 0, true, value); err != nil {
+			log.Printf("Error publishing %s alert threshold: %v", sensor.Key, err)
+		}
+	}
+}
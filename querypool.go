@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// A sensor's query result in the publish loop
+type queryResult struct {
+	values []float64
+	err    error
+}
+
+// Query every sensor, QUERY_CONCURRENCY at a time, returning the results in
+// the order of the sensors. A failed query only fails its own sensor, the
+// others are still queried.
+func queryAll(ctx context.Context, sensors []Sensor) []queryResult {
+	results := make([]queryResult, len(sensors))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(queryConcurrency, len(sensors)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				queryCtx, span := startSensorSpan(ctx, "query", sensors[i])
+				values, err := queryInfluxDB(queryCtx, sensors[i])
+				if errors.Is(err, ErrNoData) {
+					endSpan(span, nil)
+				} else {
+					endSpan(span, err)
+				}
+				results[i] = queryResult{values, err}
+			}
+		}()
+	}
+	for i := range sensors {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
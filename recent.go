@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Most recent_samples a sensor can publish, keeping the attributes well
+// under the 16 KB Home Assistant's recorder stores
+const maxRecentSamples = 500
+
+// Query the sensor's last recent_samples raw readings in its window, for a
+// sparkline in Home Assistant
+func queryRecentSamples(ctx context.Context, sensor Sensor) ([]json.Number, error) {
+	raw := sensor
+	raw.Aggregation = ""
+	raw.AggregateEvery = ""
+	raw.Smoothing = ""
+	query, params := buildSensorQuery(raw, queryRangeStart(sensor), queryStop)
+	query += fmt.Sprintf(" \n\t\t|> tail(n: %d)", sensor.RecentSamples)
+
+	values, err := queryInfluxDBValue(ctx, sensor.Key+" recent samples", query, params, "_value")
+	if err != nil {
+		return nil, err
+	}
+	return sensor.formatArray(sensor.clamp(sensor.convert(values))), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"slices"
+)
+
+// Reload CONFIG_FILE on SIGHUP without reconnecting. A config that doesn't
+// load is logged and the current one kept. Otherwise the discovery configs
+// of entities that are gone are cleared, so Home Assistant removes them, and
+// the new configs are published.
+func reloadConfig(conns []*mqttConnection) {
+	if configFile == "" {
+		log.Println("Ignoring SIGHUP, there is no CONFIG_FILE to reload")
+		return
+	}
+	log.Printf("Reloading config file %s...", configFile)
+	loaded, err := readConfig(configFile)
+	if err != nil {
+		log.Printf("Error reloading config, keeping the current one: %v", err)
+		return
+	}
+	checkUnits(loaded.sensors)
+
+	configMu.Lock()
+	old, oldEntries := sensors, discoveryConfigs()
+	useConfig(loaded)
+	entries := discoveryConfigs()
+	configMu.Unlock()
+
+	// Results of the old queries don't apply to the new ones
+	cacheMu.Lock()
+	clear(resultCache)
+	cacheMu.Unlock()
+
+	for _, entry := range oldEntries {
+		if slices.ContainsFunc(entries, func(e discoveryEntry) bool { return e.Topic == entry.Topic }) {
+			continue
+		}
+		if err := publishAllWithRetry(conns, entry.Topic, configQoS, true, ""); err != nil {
+			log.Printf("Error removing discovery config for %s: %v", entry.Config.Name, err)
+			continue
+		}
+		log.Printf("Removed discovery config for %s", entry.Config.Name)
+	}
+	publishMqttConfig(conns)
+	resubscribeAlertNumbers(conns, old)
+
+	added, removed := 0, 0
+	for _, sensor := range sensors {
+		if !slices.ContainsFunc(old, func(s Sensor) bool { return s.Key == sensor.Key }) {
+			added++
+		}
+	}
+	for _, sensor := range old {
+		if !slices.ContainsFunc(sensors, func(s Sensor) bool { return s.Key == sensor.Key }) {
+			removed++
+			clearAttributes(conns, sensor)
+		}
+	}
+	// A changed sensor may publish other attributes, start over
+	clear(publishedAttributes)
+	log.Printf("Reloaded config file %s (%d sensors, %d added, %d removed)", configFile, len(sensors), added, removed)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// A raw reading of a sensor's field
+type replayPoint struct {
+	Time   time.Time
+	Sensor int // Index in sensors
+	Value  float64
+}
+
+// Parse the START STOP SPEED arguments of --replay
+func parseReplayArgs(args []string) (time.Time, time.Time, float64, error) {
+	if len(args) != 3 {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("expected START STOP SPEED, e.g. 2025-03-01T00:00:00Z 2025-03-02T00:00:00Z 60")
+	}
+	start, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("START: %v", err)
+	}
+	stop, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("STOP: %v", err)
+	}
+	if !stop.After(start) {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("STOP has to be after START")
+	}
+	speed, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || speed <= 0 {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("SPEED %q is not a positive number", args[2])
+	}
+	return start, stop, speed, nil
+}
+
+// Which sensors can be replayed: those with a generated query of a field
+func (s Sensor) replayable() bool {
+	return s.Query == "" && s.Compute == "" && !s.Accumulate && !s.Delta && !s.publishesArray()
+}
+
+// Query the raw readings of every sensor between start and stop and publish
+// them to the state topics in time order, waiting between them for the time
+// that passed divided by speed. A sensor over the day shows the running
+// aggregate of its readings since midnight (or start), a rolling window
+// sensor each reading as it is.
+func runReplay(conns []*mqttConnection, start, stop time.Time, speed float64) {
+	client := newInfluxClient()
+	defer client.Close()
+	queryAPI := client.QueryAPI(influxOrg)
+
+	var points []replayPoint
+	for i, sensor := range sensors {
+		if !sensor.replayable() {
+			log.Printf("Not replaying %s, it has no field of its own", sensor.Key)
+			continue
+		}
+		raw := sensor
+		raw.Aggregation = ""
+		raw.AggregateEvery = ""
+		raw.Smoothing = ""
+		query, params := buildSensorQuery(raw, start.Format(time.RFC3339), stop.Format(time.RFC3339))
+
+		ctx, cancel := queryContext(context.Background())
+		sensorPoints, err := readPoints(ctx, queryAPI, query, params, i)
+		cancel()
+		if err != nil {
+			log.Fatalf("Error querying %s data to replay: %v", sensor.Key, err)
+		}
+		for j := range sensorPoints {
+			sensorPoints[j].Value = sensor.convert([]float64{sensorPoints[j].Value})[0]
+		}
+		points = append(points, sensorPoints...)
+	}
+	slices.SortStableFunc(points, func(a, b replayPoint) int { return a.Time.Compare(b.Time) })
+	log.Printf("Replaying %d readings from %s to %s at %g× speed", len(points), start.Format(time.RFC3339), stop.Format(time.RFC3339), speed)
+
+	values := make([][]float64, len(sensors))
+	skip := make([]bool, len(sensors))
+	for i := range skip {
+		skip[i] = true // Until the sensor's first reading
+	}
+	running := make([]runningAggregate, len(sensors))
+	previous := start
+	for n, point := range points {
+		time.Sleep(time.Duration(float64(point.Time.Sub(previous)) / speed))
+		previous = point.Time
+
+		sensor := sensors[point.Sensor]
+		values[point.Sensor] = sensor.clamp([]float64{running[point.Sensor].add(sensor, point.Time, point.Value)})
+		skip[point.Sensor] = false
+		// Readings at the same time go out together in the combined payload
+		if combinedJSON && !sensor.hasExternalTopic() {
+			if n+1 < len(points) && points[n+1].Time.Equal(point.Time) {
+				continue
+			}
+			if err := publishCombinedJSON(conns, values, skip); err != nil {
+				log.Printf("Error publishing combined data: %v", err)
+			}
+			continue
+		}
+		if err := publishSensor(conns, sensor, values[point.Sensor]); err != nil {
+			log.Printf("Error publishing %s data: %v", sensor.Key, err)
+		}
+	}
+	fmt.Printf("Replayed %d readings\n", len(points))
+}
+
+// Run a query and read the time and numeric value of every record
+func readPoints(ctx context.Context, queryAPI api.QueryAPI, query string, params map[string]interface{}, sensor int) ([]replayPoint, error) {
+	result, err := runQuery(ctx, queryAPI, query, params)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var points []replayPoint
+	for result.Next() {
+		if v, ok := recordFloat(result.Record().Value()); ok {
+			points = append(points, replayPoint{Time: result.Record().Time(), Sensor: sensor, Value: v})
+		}
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("result error: %v", result.Err())
+	}
+	return points, nil
+}
+
+// A sensor's aggregation over the readings replayed so far today
+type runningAggregate struct {
+	day                  time.Time
+	count                int
+	sum, min, max, first float64
+	last, increase       float64
+}
+
+// Add a reading and return the aggregate the sensor would have published
+// then. Rolling windows, median and quantile aren't kept, the reading is
+// returned.
+func (a *runningAggregate) add(sensor Sensor, t time.Time, value float64) float64 {
+	if sensor.Window != "" && sensor.Window != "today" {
+		return value
+	}
+	if day := midnight(t.Local()); !day.Equal(a.day) {
+		*a = runningAggregate{day: day}
+	}
+	if a.count == 0 {
+		a.min, a.max, a.first = value, value, value
+	} else if value > a.last {
+		a.increase += value - a.last
+	} else if value < a.last && sensor.Aggregation == "increase" {
+		a.increase += value // A counter reset, counting from 0 again
+	}
+	a.count++
+	a.sum += value
+	a.min = min(a.min, value)
+	a.max = max(a.max, value)
+	a.last = value
+
+	switch sensor.Aggregation {
+	case "sum":
+		return a.sum
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	case "mean":
+		return a.sum / float64(a.count)
+	case "first":
+		return a.first
+	case "count":
+		return float64(a.count)
+	case "spread":
+		return a.max - a.min
+	case "increase":
+		return a.increase
+	}
+	return value
+}
@@ -0,0 +1,24 @@
+package main
+
+import "log"
+
+var resetsMetric = newCounter("bridge_resets_total", "Drops in a total_increasing sensor's value, which home assistant takes as a meter reset.")
+
+// Last value queried for each total_increasing sensor
+var previousTotals = make(map[string]float64)
+
+// Log when a total_increasing sensor's value drops, which home assistant
+// counts as a meter reset, such as daily rain going back to 0 at midnight.
+// Drops lost in the rounding aren't published, so they aren't resets.
+func checkReset(sensor Sensor, value float64) {
+	if sensor.StateClass != "total_increasing" {
+		return
+	}
+	previous, seen := previousTotals[sensor.Key]
+	previousTotals[sensor.Key] = value
+	if !seen || value >= previous || sensor.formatNumber(value) == sensor.formatNumber(previous) {
+		return
+	}
+	resetsMetric.add(1, "sensor", sensor.Key)
+	log.Printf("%s reset from %s to %s", sensor.Key, sensor.formatNumber(previous), sensor.formatNumber(value))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttTestTopic   = "homeassistant/sensor/%s/test"
+	selfTestTimeout = 10 * time.Second
+)
+
+// Check that InfluxDB and every MQTT broker can be reached with the configured
+// credentials, printing a PASS/FAIL line for each. Returns the exit code.
+func runSelfTest() int {
+	failed := false
+	report := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("PASS  %s\n", name)
+	}
+
+	report(fmt.Sprintf("InfluxDB %s (bucket %s)", influxQueryURL, influxBucket), testInflux())
+	for _, target := range mqttTargets {
+		report(fmt.Sprintf("MQTT %s", target.Broker), testMqtt(target))
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// Run a query against the bucket, which needs a token with read access.
+// Errors caused by the token say so.
+func testInflux() error {
+	client := newInfluxClient()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`from(bucket: "%s") |> range(start: -1m) |> limit(n: 1)`, influxBucket)
+	result, err := client.QueryAPI(influxOrg).Query(ctx, query)
+	if err != nil {
+		if problem := permissionProblem(err); problem != "" {
+			return fmt.Errorf("%s: %w", problem, err)
+		}
+		return err
+	}
+	defer result.Close()
+	for result.Next() {
+	}
+	return result.Err()
+}
+
+// Connect and publish a non-retained message to the test topic. A set client
+// ID gets a -test suffix so a running bridge isn't disconnected.
+func testMqtt(target mqttTarget) error {
+	opts := newMqttOptions(target).SetAutoReconnect(false).SetCleanSession(true)
+	if target.ClientID != "" {
+		opts.SetClientID(target.ClientID + "-test")
+	}
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(selfTestTimeout) {
+		return fmt.Errorf("timed out connecting")
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+	defer client.Disconnect(250)
+
+	topic := fmt.Sprintf(mqttTestTopic, mqttSensor)
+	token = client.Publish(topic, 1, false, "test")
+	if !token.WaitTimeout(selfTestTimeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	return token.Error()
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A Home Assistant sensor backed by an aggregation of an InfluxDB field
+type Sensor struct {
+	Key         string `json:"key"` // Topic segment and unique ID suffix, e.g. temperature-max
+	Name        string `json:"name"`
+	Field       string `json:"field"`
+	Aggregation string `json:"aggregation"`
+	DeviceClass string `json:"device_class"`
+	Unit        string `json:"unit"`
+	StateClass  string `json:"state_class"`
+	JSONKey     string `json:"json_key"`   // Key in the combined JSON payload, defaults to Key
+	JSONGroup   string `json:"json_group"` // Object in the combined JSON payload the key is nested in
+
+	// Config file only, expands the entry into one sensor per aggregation
+	// and window
+	Aggregations []string `json:"aggregations"`
+	Windows      []string `json:"windows"`
+	ForceUpdate  bool     `json:"force_update"`
+
+	// Custom Flux replacing the generated query, {bucket}, {measurement},
+	// {start} and {stop} are replaced with the bucket, INFLUX_MEASUREMENT and
+	// range. The value is read from ResultColumn, _value by default.
+	Query        string `json:"query"`
+	ResultColumn string `json:"result_column"`
+
+	// Range queried: "today" (since midnight, the default) or a rolling
+	// window given as a Flux duration such as 10m
+	Window string `json:"window"`
+
+	// A binary_sensor is on while the queried value is above Threshold
+	Component  string   `json:"component"`
+	Threshold  *float64 `json:"threshold"`
+	PayloadOn  string   `json:"payload_on"`
+	PayloadOff string   `json:"payload_off"`
+
+	// Set to false to add the entity to Home Assistant disabled
+	EnabledByDefault *bool `json:"enabled_by_default"`
+
+	// Downsample with aggregateWindow, publishing the last window's value or,
+	// with WindowValues "array", every window's value
+	AggregateEvery string `json:"aggregate_every"`
+	WindowValues   string `json:"window_values"`
+
+	// Quantile of the quantile aggregation, e.g. 0.95 for the 95th percentile
+	Quantile float64 `json:"quantile"`
+
+	// Reuse a query's result for this long, a Go duration such as 10m,
+	// instead of querying InfluxDB every loop
+	CacheTTL string `json:"cache_ttl"`
+
+	// Record of a multi-record result to publish, "first" or "last"
+	Record string `json:"record"`
+
+	// Combine a result with several tables into one value, taking each
+	// table's record: sum, mean, min or max
+	Tables string `json:"tables"`
+
+	// Publish the last N raw readings as the recent attribute
+	RecentSamples int `json:"recent_samples"`
+
+	// What to publish when the query returns no rows: zero (the default),
+	// unavailable, last_value or skip
+	NoDataBehavior string `json:"no_data_behavior"`
+
+	// Fill gaps with "previous" (carry the last value forward) or a number
+	Fill string `json:"fill"`
+
+	// Smooth the raw points before aggregating with a Flux moving average
+	// function. SmoothingPeriod is a duration for timedMovingAverage (output
+	// every SmoothingEvery, 1m by default) and a number of points otherwise.
+	Smoothing       string `json:"smoothing"`
+	SmoothingPeriod string `json:"smoothing_period"`
+	SmoothingEvery  string `json:"smoothing_every"`
+
+	// Publish an event to AlertTopic when the value rises above
+	// AlertThreshold, and again once it drops below the threshold minus
+	// AlertHysteresis
+	AlertThreshold  *float64 `json:"alert_threshold"`
+	AlertHysteresis float64  `json:"alert_hysteresis"`
+	AlertTopic      string   `json:"alert_topic"`
+
+	// Add a number entity adjusting the alert threshold from Home Assistant
+	AlertNumber *alertNumber `json:"alert_number"`
+
+	// Read the field from each of these measurements instead of the one it
+	// maps to, aggregating their points together
+	Measurements []string `json:"measurements"`
+
+	// Only read the points with these tag values, e.g. {"station": "garden"}
+	Tags map[string]string `json:"tags"`
+
+	// Flux imports and options put before this sensor's query, after the
+	// config file's flux_preamble
+	FluxPreamble string `json:"flux_preamble"`
+
+	// Publish the value as text, "cardinal" turns degrees into a 16 point
+	// compass direction such as NNE, "trend" a trend sensor's change into
+	// rising, falling or steady
+	Format string `json:"format"`
+	Icon   string `json:"icon"`
+
+	// Compute the value in Go from the latest readings of several fields:
+	// heat_index, wind_chill, feels_like or "expression", evaluating
+	// Expression with its variables as inputs. Inputs maps inputs to
+	// logical fields other than their names.
+	Compute    string            `json:"compute"`
+	Expression string            `json:"expression"`
+	Inputs     map[string]string `json:"inputs"`
+
+	// With "compute": "trend", the pressure change over TrendPeriod (3h by
+	// default) and, with format "trend", the change counting as rising or
+	// falling (1 by default) and how far back it has to fall to be steady
+	TrendPeriod     string  `json:"trend_period"`
+	TrendThreshold  float64 `json:"trend_threshold"`
+	TrendHysteresis float64 `json:"trend_hysteresis"`
+
+	// Treat the field as a rate per hour, such as a rain rate, and publish
+	// its integral since midnight. The running total is kept in
+	// ACCUMULATOR_FILE across restarts.
+	Accumulate bool `json:"accumulate"`
+
+	// Publish how much the queried value, a counter that only grows such as
+	// a rain gauge's total ever, rose since the previous loop. The last value
+	// is kept in ACCUMULATOR_FILE across restarts.
+	Delta bool `json:"delta"`
+
+	// Unit the field is stored in, converted to Unit before publishing
+	SourceUnit string `json:"source_unit"`
+
+	// nearest, floor, ceil or truncate to the decimals of NumberFormat,
+	// ROUNDING_MODE when empty
+	Rounding string `json:"rounding"`
+
+	// Go format verb the value is published with, %.2f by default, e.g.
+	// %.0f for solar radiation or %g
+	NumberFormat string `json:"number_format"`
+
+	// Limit the queried values to this range, e.g. a clamp_min of 0 stops a
+	// counter reset making a rain total negative
+	ClampMin *float64 `json:"clamp_min"`
+	ClampMax *float64 `json:"clamp_max"`
+
+	// Readings outside this range are glitches. Generated queries drop them
+	// before aggregating, results of custom queries and computed sensors
+	// outside it aren't published.
+	ValidMin *float64 `json:"valid_min"`
+	ValidMax *float64 `json:"valid_max"`
+
+	// Publish to this topic instead of the generated one, feeding an entity
+	// that already exists in Home Assistant. No discovery config is sent.
+	StateTopic string `json:"state_topic"`
+}
+
+// Sensors published when no config file overrides them
+var defaultSensors = []Sensor{
+	{Key: "rain", Name: "Rainfall Sensor", Field: "rain", Aggregation: "sum", DeviceClass: "precipitation", Unit: "mm", StateClass: "total_increasing"},
+	{Key: "wind-max", Name: "Max Wind Speed", Field: "wind", Aggregation: "max", DeviceClass: "wind_speed", Unit: "km/h", StateClass: "measurement"},
+	{Key: "wind-mean", Name: "Average Wind Speed", Field: "wind", Aggregation: "mean", DeviceClass: "wind_speed", Unit: "km/h", StateClass: "measurement"},
+	{Key: "wind-gust-max", Name: "Max Wind Gust Speed", Field: "wind-gust", Aggregation: "max", DeviceClass: "wind_speed", Unit: "km/h", StateClass: "measurement"},
+	{Key: "temperature-min", Name: "Minimum Temperature", Field: "temperature", Aggregation: "min", DeviceClass: "temperature", Unit: "°C", StateClass: "measurement"},
+	{Key: "temperature-max", Name: "Maximum Temperature", Field: "temperature", Aggregation: "max", DeviceClass: "temperature", Unit: "°C", StateClass: "measurement"},
+	{Key: "humidity-min", Name: "Minimum Humidity", Field: "humidity", Aggregation: "min", DeviceClass: "humidity", Unit: "%", StateClass: "measurement"},
+	{Key: "humidity-max", Name: "Maximum Humidity", Field: "humidity", Aggregation: "max", DeviceClass: "humidity", Unit: "%", StateClass: "measurement"},
+	{Key: "pressure-min", Name: "Minimum Pressure", Field: "pressure", Aggregation: "min", DeviceClass: "pressure", Unit: "hPa", StateClass: "measurement"},
+	{Key: "pressure-max", Name: "Maximum Pressure", Field: "pressure", Aggregation: "max", DeviceClass: "pressure", Unit: "hPa", StateClass: "measurement"},
+}
+
+// Sensors in use, loaded at startup
+var sensors []Sensor
+
+func (s Sensor) resultColumn() string {
+	if s.ResultColumn == "" {
+		return "_value"
+	}
+	return s.ResultColumn
+}
+
+func (s Sensor) component() string {
+	if s.Component == "" {
+		return "sensor"
+	}
+	return s.Component
+}
+
+func (s Sensor) isBinary() bool {
+	return s.component() == "binary_sensor"
+}
+
+func (s Sensor) payloadOn() string {
+	if s.PayloadOn == "" {
+		return "ON"
+	}
+	return s.PayloadOn
+}
+
+func (s Sensor) payloadOff() string {
+	if s.PayloadOff == "" {
+		return "OFF"
+	}
+	return s.PayloadOff
+}
+
+// Limit values to the sensor's clamp range, logging each clamped value
+func (s Sensor) clamp(values []float64) []float64 {
+	for i, v := range values {
+		if s.ClampMin != nil && v < *s.ClampMin {
+			values[i] = *s.ClampMin
+		} else if s.ClampMax != nil && v > *s.ClampMax {
+			values[i] = *s.ClampMax
+		} else {
+			continue
+		}
+		log.Printf("Clamped %s value %.2f to %.2f", s.Key, v, values[i])
+	}
+	return values
+}
+
+// Whether the state is text rather than a number
+func (s Sensor) publishesText() bool {
+	return s.isBinary() || s.Format != ""
+}
+
+func (s Sensor) icon() string {
+	if s.Icon == "" && s.Format == "cardinal" {
+		return "mdi:compass-outline"
+	}
+	return s.Icon
+}
+
+// The state payload for a value
+func (s Sensor) formatValue(value float64) string {
+	if s.isBinary() {
+		if value > *s.Threshold {
+			return s.payloadOn()
+		}
+		return s.payloadOff()
+	}
+	if s.Format == "cardinal" {
+		return cardinalDirection(value)
+	}
+	if s.Format == "trend" {
+		return s.trend(value)
+	}
+	return s.formatNumber(value)
+}
+
+// A value in the sensor's number format, rounded with its rounding mode to
+// the format's decimals. nearest is left to Sprintf, which rounds the exact
+// binary value.
+func (s Sensor) formatNumber(value float64) string {
+	// Scaled values such as 0.29*100 land just below the whole number, the
+	// tolerance stops floor and truncate from losing a hundredth to that
+	const tolerance = 1e-9
+	scale := math.Pow10(s.decimals())
+	switch s.rounding() {
+	case "floor":
+		value = math.Floor(value*scale+tolerance) / scale
+	case "ceil":
+		value = math.Ceil(value*scale-tolerance) / scale
+	case "truncate":
+		if value < 0 {
+			value = math.Ceil(value*scale-tolerance) / scale
+		} else {
+			value = math.Floor(value*scale+tolerance) / scale
+		}
+	}
+	return fmt.Sprintf(s.numberFormat(), value)
+}
+
+// Formats a state can be published with: %f, %e or %g with an optional
+// precision. Flags and widths are left out, "+1.0" or "001.5" aren't JSON
+// numbers.
+var numberFormatPattern = regexp.MustCompile(`^%(\.\d+)?[efg]$`)
+
+func (s Sensor) numberFormat() string {
+	if s.NumberFormat == "" {
+		return "%.2f"
+	}
+	return s.NumberFormat
+}
+
+// The decimals of a %f number format, 6 without a precision like Sprintf.
+// The other formats are only rounded to nearest.
+func (s Sensor) decimals() int {
+	format := s.numberFormat()
+	precision, ok := strings.CutPrefix(strings.TrimSuffix(format, "f"), "%.")
+	if !ok || !strings.HasSuffix(format, "f") {
+		return 6
+	}
+	n, _ := strconv.Atoi(precision)
+	return n
+}
+
+func (s Sensor) rounding() string {
+	if s.Rounding != "" {
+		return s.Rounding
+	}
+	return roundingMode
+}
+
+var roundingModes = map[string]bool{"nearest": true, "floor": true, "ceil": true, "truncate": true}
+
+var compassPoints = []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+
+// The 16 point compass direction of a bearing in degrees, each point
+// covering 22.5° centred on its bearing
+func cardinalDirection(degrees float64) string {
+	degrees = math.Mod(degrees, 360)
+	if degrees < 0 {
+		degrees += 360
+	}
+	return compassPoints[int(math.Round(degrees/22.5))%len(compassPoints)]
+}
+
+func (s Sensor) stateTopic() string {
+	if s.StateTopic != "" {
+		return s.StateTopic
+	}
+	if stateTopicTemplate != "" {
+		return s.expandTopicTemplate(stateTopicTemplate)
+	}
+	return fmt.Sprintf(mqttStateTopic, s.component(), mqttSensor, s.Key)
+}
+
+// Placeholders of STATE_TOPIC_TEMPLATE and the topic segment they become
+var topicPlaceholders = map[string]func(s Sensor) string{
+	"{id}":           func(Sensor) string { return mqttSensor },
+	"{area}":         func(Sensor) string { return topicSegment(deviceArea) },
+	"{component}":    func(s Sensor) string { return s.component() },
+	"{device_class}": func(s Sensor) string { return topicSegment(s.DeviceClass) },
+	"{field}":        func(s Sensor) string { return topicSegment(s.Field) },
+	"{key}":          func(s Sensor) string { return s.Key },
+}
+
+var topicPlaceholder = regexp.MustCompile(`\{[a-z_]*\}`)
+
+func (s Sensor) expandTopicTemplate(template string) string {
+	return topicPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return topicPlaceholders[placeholder](s)
+	})
+}
+
+// Lower case with spaces as underscores, none for an empty value
+func topicSegment(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return strings.ReplaceAll(strings.ToLower(value), " ", "_")
+}
+
+// Check a state topic template only uses known placeholders and has {key},
+// the only one that is different for every sensor
+func validateTopicTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	if strings.ContainsAny(template, "+#") {
+		return fmt.Errorf("%q can't contain wildcards", template)
+	}
+	for _, placeholder := range topicPlaceholder.FindAllString(template, -1) {
+		if _, ok := topicPlaceholders[placeholder]; !ok {
+			return fmt.Errorf("unknown placeholder %s in %q", placeholder, template)
+		}
+	}
+	if !strings.Contains(template, "{key}") {
+		return fmt.Errorf("%q needs {key} so every sensor gets its own topic", template)
+	}
+	return nil
+}
+
+func (s Sensor) uniqueID() string {
+	return fmt.Sprintf("%s-sensor-%s", mqttSensor, s.Key)
+}
+
+var nonSlugCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+
+// The discovery object_id of an entity, MQTT_SENSOR and the key as a slug
+// such as influx_import_rain. Home Assistant builds the entity ID from it
+// rather than the name, so renaming the device doesn't change it.
+func objectID(key string) string {
+	return strings.Trim(nonSlugCharacters.ReplaceAllString(strings.ToLower(mqttSensor+"_"+key), "_"), "_")
+}
+
+func (s Sensor) hasExternalTopic() bool {
+	return s.StateTopic != ""
+}
+
+// The measurements and field a generated query reads
+func (s Sensor) source() ([]string, string) {
+	measurement, field := resolveField(s.Field)
+	if len(s.Measurements) > 0 {
+		return s.Measurements, field
+	}
+	return []string{measurement}, field
+}
+
+func (s Sensor) configTopic() string {
+	return fmt.Sprintf(mqttConfigTopic, s.component(), mqttSensor, s.Key)
+}
+
+func (s Sensor) jsonKey() string {
+	if s.JSONKey != "" {
+		return s.JSONKey
+	}
+	return s.Key
+}
+
+func (s Sensor) publishesArray() bool {
+	return s.AggregateEvery != "" && s.WindowValues == "array"
+}
+
+// Reduce a query result to the record the sensor publishes. The last is
+// published unless record is "first", array sensors keep every record.
+func (s Sensor) selectRecord(values []float64) []float64 {
+	if s.Record != "first" || s.publishesArray() || len(values) == 0 {
+		return values
+	}
+	return values[:1]
+}
+
+// Combine a result's tables into one value: each table's first or last
+// record, per record, summed, averaged or the smallest or largest of them.
+// Tables without values are left out.
+func (s Sensor) combineTables(tables [][]float64) []float64 {
+	var selected []float64
+	for _, table := range tables {
+		if len(table) == 0 {
+			continue
+		}
+		if s.Record == "first" {
+			selected = append(selected, table[0])
+		} else {
+			selected = append(selected, table[len(table)-1])
+		}
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+	combined := selected[0]
+	for _, v := range selected[1:] {
+		switch s.Tables {
+		case "sum", "mean":
+			combined += v
+		case "min":
+			combined = math.Min(combined, v)
+		case "max":
+			combined = math.Max(combined, v)
+		}
+	}
+	if s.Tables == "mean" {
+		combined /= float64(len(selected))
+	}
+	return []float64{combined}
+}
+
+var jinjaIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// The template expression selecting the sensor's value from the combined
+// JSON payload
+func (s Sensor) jsonValuePath() string {
+	if s.JSONGroup != "" {
+		return jsonValuePath(s.JSONGroup, s.jsonKey())
+	}
+	return jsonValuePath(s.jsonKey())
+}
+
+// Build the template expression that selects a key, or a key nested in
+// objects, from a JSON payload. Keys that aren't valid identifiers (e.g.
+// wind-max) need subscript syntax.
+func jsonValuePath(keys ...string) string {
+	path := "value_json"
+	for _, key := range keys {
+		if jinjaIdentifier.MatchString(key) {
+			path += "." + key
+		} else {
+			path += fmt.Sprintf("['%s']", key)
+		}
+	}
+	return path
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCombineTables(t *testing.T) {
+	tables := [][]float64{{1, 2}, {}, {6, 4}, {3}}
+	tests := []struct {
+		tables, record string
+		want           []float64
+	}{
+		{"sum", "", []float64{9}},
+		{"mean", "", []float64{3}},
+		{"min", "", []float64{2}},
+		{"max", "", []float64{4}},
+		{"sum", "first", []float64{10}},
+		{"max", "first", []float64{6}},
+	}
+	for _, tt := range tests {
+		s := Sensor{Tables: tt.tables, Record: tt.record}
+		if got := s.combineTables(tables); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("combineTables() with %s of the %q records = %v, want %v", tt.tables, tt.record, got, tt.want)
+		}
+	}
+
+	// Nothing to combine is no value, which publishes like an empty result
+	if got := (Sensor{Tables: "sum"}).combineTables([][]float64{{}, nil}); got != nil {
+		t.Errorf("combineTables() of empty tables = %v, want nil", got)
+	}
+}
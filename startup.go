@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// The wait after a loop while the bridge is starting. Until a loop has
+// published every sensor the next one comes after STARTUP_RETRY_INTERVAL,
+// up to STARTUP_RETRIES times, so an entity isn't left empty for a whole
+// PUBLISH_INTERVAL by a failed first query. The normal delay is kept once a
+// loop succeeds or the retries run out, or when it is the shorter one.
+func startupDelay(ok bool, retriesLeft *int, delay time.Duration) time.Duration {
+	if ok {
+		*retriesLeft = 0
+		return delay
+	}
+	*retriesLeft--
+	if startupRetryInterval >= delay {
+		return delay
+	}
+	log.Printf("Not every sensor published yet, startup retry %d/%d in %s", startupRetries-*retriesLeft, startupRetries, startupRetryInterval)
+	return startupRetryInterval
+}
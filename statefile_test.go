@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	state := map[string]float64{"kept": 1}
+	if err := readStateFile(path, &state); err != nil {
+		t.Fatalf("readStateFile() of a missing file = %v, want nil", err)
+	}
+	if want := map[string]float64{"kept": 1}; !reflect.DeepEqual(state, want) {
+		t.Errorf("missing file changed the state to %v", state)
+	}
+
+	saved := map[string]float64{"rain": 2.5}
+	if err := writeStateFile(path, saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	loaded := map[string]float64{}
+	if err := readStateFile(path, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("readStateFile() = %v, want %v", loaded, saved)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := readStateFile(path, &loaded); err == nil {
+		t.Error("readStateFile() of a broken file = nil, want an error")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans are dropped until setupTracing installs an exporter
+var tracer = otel.Tracer("influx-mqtt-homeassistant")
+
+// Export traces over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT is set. The
+// exporter reads the other OTEL_EXPORTER_OTLP_* variables itself. Returns a
+// function flushing the remaining spans.
+func setupTracing() func() {
+	if getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "") == "" {
+		return func() {}
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to create OTLP trace exporter: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("influx-mqtt-homeassistant"))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Printf("Exporting traces to %s", getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""))
+
+	return func() {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			log.Printf("Error flushing traces: %v", err)
+		}
+	}
+}
+
+// Start a span for one sensor's query or publish
+func startSensorSpan(ctx context.Context, name string, sensor Sensor) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("sensor", sensor.Key)))
+}
+
+// End a span, marking it failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// The latest trend of each trend sensor, which the hysteresis is applied to
+var (
+	trendMu     sync.Mutex
+	trendStates = make(map[string]string)
+)
+
+func (s Sensor) trendPeriod() time.Duration {
+	if s.TrendPeriod == "" {
+		return 3 * time.Hour
+	}
+	period, _ := time.ParseDuration(s.TrendPeriod) // Checked when the config is loaded
+	return period
+}
+
+func (s Sensor) trendThreshold() float64 {
+	if s.TrendThreshold == 0 {
+		return 1
+	}
+	return s.TrendThreshold
+}
+
+// Classify a change as rising, falling or steady. A change past the
+// threshold either way starts a trend, which only ends once the change is
+// back within the threshold minus the hysteresis, so a change hovering
+// around the threshold doesn't flap.
+func (s Sensor) trend(change float64) string {
+	threshold := s.trendThreshold()
+	trendMu.Lock()
+	previous := trendStates[s.Key]
+	trendMu.Unlock()
+	switch {
+	case change >= threshold:
+		return "rising"
+	case change <= -threshold:
+		return "falling"
+	case previous == "rising" && change > threshold-s.TrendHysteresis:
+		return "rising"
+	case previous == "falling" && change < -(threshold-s.TrendHysteresis):
+		return "falling"
+	}
+	return "steady"
+}
+
+// The change of a trend sensor's input from the latest reading in the hour
+// before the trend period to the current one
+func queryTrend(ctx context.Context, sensor Sensor, current float64) (float64, error) {
+	end := clock()
+	if queryStop != "" {
+		end = parseTime(queryStop)
+	}
+	then := end.Add(-sensor.trendPeriod())
+
+	inputSensor := sensor
+	inputSensor.Key = sensor.Key + "-past"
+	inputSensor.Field = sensor.inputField("pressure")
+	inputSensor.Aggregation = "last"
+	inputSensor.ValidMin, inputSensor.ValidMax = nil, nil
+
+	log.Printf("Querying InfluxDB for %s data %s ago...\n", inputSensor.Field, sensor.trendPeriod())
+	query, params := buildSensorQuery(inputSensor, then.Add(-time.Hour).Format(time.RFC3339), then.Format(time.RFC3339))
+	values, err := queryInfluxDBValue(ctx, inputSensor.Key, query, params, "_value")
+	if err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return 0, fmt.Errorf("no %s readings %s ago for %s: %w", inputSensor.Field, sensor.trendPeriod(), sensor.Key, ErrNoData)
+	}
+
+	change := current - lastValue(values)
+	trend := sensor.trend(change)
+	trendMu.Lock()
+	trendStates[sensor.Key] = trend
+	trendMu.Unlock()
+	return change, nil
+}
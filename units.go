@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Units Home Assistant accepts for the device classes used with weather data,
+// from its sensor DEVICE_CLASS_UNITS. Unlisted device classes aren't checked.
+var deviceClassUnits = map[string][]string{
+	"temperature":             {"°C", "°F", "K"},
+	"humidity":                {"%"},
+	"moisture":                {"%"},
+	"pressure":                {"Pa", "hPa", "kPa", "bar", "cbar", "mbar", "mmHg", "inHg", "psi"},
+	"atmospheric_pressure":    {"Pa", "hPa", "kPa", "bar", "cbar", "mbar", "mmHg", "inHg", "psi"},
+	"precipitation":           {"cm", "in", "mm"},
+	"precipitation_intensity": {"in/d", "in/h", "mm/d", "mm/h"},
+	"wind_speed":              {"ft/s", "km/h", "kn", "m/s", "mph", "Beaufort"},
+	"speed":                   {"ft/s", "in/d", "in/h", "in/s", "km/h", "kn", "m/s", "mm/d", "mm/s", "mph", "Beaufort"},
+	"distance":                {"km", "m", "cm", "mm", "mi", "nmi", "yd", "in", "ft"},
+	"illuminance":             {"lx"},
+	"irradiance":              {"W/m²", "BTU/(h⋅ft²)"},
+	"battery":                 {"%"},
+	"voltage":                 {"V", "mV", "µV", "kV", "MV"},
+	"signal_strength":         {"dB", "dBm"},
+	"pm25":                    {"µg/m³"},
+	"pm10":                    {"µg/m³"},
+	"carbon_dioxide":          {"ppm"},
+	"aqi":                     {""},
+}
+
+// Log a warning for each sensor whose unit Home Assistant won't accept for its
+// device class, such as a temperature in %
+func checkUnits(sensors []Sensor) {
+	for _, s := range sensors {
+		if s.DeviceClass == "" || s.publishesText() {
+			continue
+		}
+		units, known := deviceClassUnits[s.DeviceClass]
+		if !known || slices.Contains(units, s.Unit) {
+			continue
+		}
+		valid := slices.Clone(units)
+		slices.Sort(valid)
+		log.Printf("Warning: sensor %s has unit %q, which Home Assistant doesn't accept for device class %s (use one of %s)", s.Key, s.Unit, s.DeviceClass, strings.Join(valid, ", "))
+	}
+}
+
+// A unit the bridge can convert, as a scale and offset to its dimension's
+// base unit: base = value*scale + offset
+type unitConversion struct {
+	dimension string
+	scale     float64
+	offset    float64
+}
+
+var unitConversions = map[string]unitConversion{
+	"°C": {"temperature", 1, 0},
+	"°F": {"temperature", 5.0 / 9, -32 * 5.0 / 9},
+	"K":  {"temperature", 1, -273.15},
+
+	"hPa":  {"pressure", 1, 0},
+	"mbar": {"pressure", 1, 0},
+	"Pa":   {"pressure", 0.01, 0},
+	"kPa":  {"pressure", 10, 0},
+	"inHg": {"pressure", 33.8639, 0},
+	"mmHg": {"pressure", 1.333224, 0},
+	"psi":  {"pressure", 68.94757, 0},
+
+	"km/h": {"speed", 1, 0},
+	"m/s":  {"speed", 3.6, 0},
+	"mph":  {"speed", 1.609344, 0},
+	"kn":   {"speed", 1.852, 0},
+	"ft/s": {"speed", 1.09728, 0},
+
+	"mm": {"length", 1, 0},
+	"cm": {"length", 10, 0},
+	"in": {"length", 25.4, 0},
+
+	"mm/h": {"rate", 1, 0},
+	"in/h": {"rate", 25.4, 0},
+}
+
+// The unit the sensor's values are converted from. An accumulate sensor
+// integrates its rate per hour, so its total is in the rate's length, e.g. in
+// for a field in in/h.
+func (s Sensor) sourceUnit() string {
+	if s.Accumulate {
+		return strings.TrimSuffix(s.SourceUnit, "/h")
+	}
+	return s.SourceUnit
+}
+
+// Check a sensor's source unit can be converted to its unit
+func validateSourceUnit(s Sensor) error {
+	if s.SourceUnit == "" {
+		return nil
+	}
+	if s.Compute != "" {
+		return fmt.Errorf("source_unit can't be used with compute, the formulas expect °C, %% and km/h readings")
+	}
+	from, ok := unitConversions[s.SourceUnit]
+	if !ok {
+		return fmt.Errorf("unknown source_unit %q", s.SourceUnit)
+	}
+	if s.Accumulate {
+		if from.dimension != "rate" {
+			return fmt.Errorf("accumulate integrates a rate, source_unit has to be per hour, e.g. in/h")
+		}
+		from = unitConversions[s.sourceUnit()]
+	}
+	to, ok := unitConversions[s.Unit]
+	if !ok {
+		return fmt.Errorf("can't convert to unit %q", s.Unit)
+	}
+	if from.dimension != to.dimension {
+		return fmt.Errorf("can't convert %s to %s", s.sourceUnit(), s.Unit)
+	}
+	if s.Aggregation == "count" {
+		return fmt.Errorf("a count has no unit to convert")
+	}
+	return nil
+}
+
+// Convert values from the sensor's source unit to its unit. A spread is a
+// difference, so only the scale applies.
+func (s Sensor) convert(values []float64) []float64 {
+	if s.SourceUnit == "" || s.sourceUnit() == s.Unit {
+		return values
+	}
+	from, to := unitConversions[s.sourceUnit()], unitConversions[s.Unit]
+	difference := s.Aggregation == "spread"
+	for i, v := range values {
+		if difference {
+			values[i] = v * from.scale / to.scale
+		} else {
+			values[i] = (v*from.scale + from.offset - to.offset) / to.scale
+		}
+	}
+	return values
+}
+
+// Convert a value in the sensor's unit back to its source unit, for limits
+// compared with the stored points. nil stays nil.
+func (s Sensor) toSourceUnit(value *float64) *float64 {
+	if value == nil || s.SourceUnit == "" || s.sourceUnit() == s.Unit {
+		return value
+	}
+	from, to := unitConversions[s.sourceUnit()], unitConversions[s.Unit]
+	// Rounded so a limit of 60 °C reads 140.0 in the query, not 139.99999999999997
+	converted := math.Round((*value*to.scale+to.offset-from.offset)/from.scale*1e9) / 1e9
+	return &converted
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSourceUnit(t *testing.T) {
+	tests := []struct {
+		name   string
+		sensor Sensor
+		want   string // Part of the error, empty when valid
+	}{
+		{"fahrenheit", Sensor{Field: "temperature", Aggregation: "max", Unit: "°C", SourceUnit: "°F"}, ""},
+		{"other quantity", Sensor{Field: "temperature", Aggregation: "max", Unit: "°C", SourceUnit: "inHg"}, "can't convert"},
+		{"count", Sensor{Field: "temperature", Aggregation: "count", Unit: "°C", SourceUnit: "°F"}, "count"},
+		{"compute", Sensor{Compute: "heat_index", Unit: "°C", SourceUnit: "°F"}, "can't be used with compute"},
+		{"accumulate rate", Sensor{Field: "rain-rate", Accumulate: true, Unit: "mm", SourceUnit: "in/h"}, ""},
+		{"accumulate length", Sensor{Field: "rain-rate", Accumulate: true, Unit: "mm", SourceUnit: "in"}, "per hour"},
+		{"accumulate rate total", Sensor{Field: "rain-rate", Accumulate: true, Unit: "mm/h", SourceUnit: "in/h"}, "can't convert in to mm/h"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSourceUnit(tt.sensor)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("validateSourceUnit() = %v, want nil", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("validateSourceUnit() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertAccumulated(t *testing.T) {
+	// An hour at 0.5 in/h is a total of 0.5 in
+	s := Sensor{Accumulate: true, Unit: "mm", SourceUnit: "in/h"}
+	if got := s.convert([]float64{0.5}); got[0] != 12.7 {
+		t.Errorf("convert() = %v, want 12.7 mm", got)
+	}
+	// The valid range is applied to the rate, 25.4 mm/h is 1 in/h
+	if got := s.toSourceUnit(ptr(25.4)); *got != 1 {
+		t.Errorf("toSourceUnit() = %v, want 1 in/h", *got)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "log"
+
+// Last result of each sensor that was inside its valid range
+var lastValidValues = make(map[string][]float64)
+
+func (s Sensor) inValidRange(value float64) bool {
+	return (s.ValidMin == nil || value >= *s.ValidMin) && (s.ValidMax == nil || value <= *s.ValidMax)
+}
+
+// Check the result of a custom query or computed sensor against its valid
+// range. A result with a value outside it is replaced by the last valid
+// result, or isn't published when there is none yet. Generated queries
+// already dropped the invalid points, their aggregates such as a sum can
+// rightly be outside the range.
+func checkValidRange(sensor Sensor, values []float64) ([]float64, bool) {
+	if sensor.ValidMin == nil && sensor.ValidMax == nil || sensor.Query == "" && sensor.Compute == "" {
+		return values, true
+	}
+	for _, v := range values {
+		if sensor.inValidRange(v) {
+			continue
+		}
+		previous, ok := lastValidValues[sensor.Key]
+		if !ok {
+			log.Printf("Warning: %s value %.2f is outside its valid range, not publishing it", sensor.Key, v)
+			return nil, false
+		}
+		log.Printf("Warning: %s value %.2f is outside its valid range, publishing the last valid value", sensor.Key, v)
+		return previous, true
+	}
+	lastValidValues[sensor.Key] = values
+	return values, true
+}